@@ -0,0 +1,202 @@
+package eventsource
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Principal identifies an authenticated subscriber.
+type Principal struct {
+	// ID is the unique name of the subscriber, such as a user ID.
+	ID string
+	// SessionID identifies the login session, if the authenticator knows
+	// it. HMACTokenAuth takes it from the token.
+	SessionID string
+	// Claims holds additional attributes asserted by the authenticator.
+	Claims map[string]string
+}
+
+// An Authenticator identifies the client of a stream request. A non-nil
+// error rejects the request with 401 Unauthorized.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// A Challenger is an Authenticator that tells clients how to authenticate.
+// Its challenge is sent in the WWW-Authenticate header of 401 responses.
+type Challenger interface {
+	Challenge() string
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal of an authenticated stream
+// request, or nil. It can be used in Options.Admit.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// PrincipalIs returns a BroadcastTo filter matching the connections of the
+// principal with the given ID.
+func PrincipalIs(id string) func(*ConnectionInfo) bool {
+	return func(info *ConnectionInfo) bool {
+		return info.Principal != nil && info.Principal.ID == id
+	}
+}
+
+// authenticate runs auth and stores the principal in the request context.
+// It writes the 401 response itself if authentication fails.
+func authenticate(w http.ResponseWriter, r *http.Request, auth Authenticator) (*http.Request, *Principal, bool) {
+	p, err := auth.Authenticate(r)
+	if err != nil || p == nil {
+		if c, ok := auth.(Challenger); ok {
+			w.Header().Set("WWW-Authenticate", c.Challenge())
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return r, nil, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p)), p, true
+}
+
+// BasicAuth authenticates clients with HTTP Basic authentication. The
+// principal's ID is the user name.
+type BasicAuth struct {
+	// Realm is sent in the challenge.
+	Realm string
+	// Verify reports whether the credentials are valid.
+	Verify func(username, password string) bool
+}
+
+// Authenticate implements Authenticator.
+func (a *BasicAuth) Authenticate(r *http.Request) (*Principal, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok || !a.Verify(username, password) {
+		return nil, ErrUnauthorized
+	}
+	return &Principal{ID: username}, nil
+}
+
+// Challenge implements Challenger.
+func (a *BasicAuth) Challenge() string {
+	return `Basic realm="` + strings.ReplaceAll(a.Realm, `"`, "") + `", charset="UTF-8"`
+}
+
+// HMACTokenAuth authenticates clients with tokens created by SignToken. The
+// token is taken from an "Authorization: Bearer" header, the cookie named
+// CookieName or the query parameter named QueryParam, in that order. The
+// query parameter serves EventSource implementations that cannot set
+// headers.
+type HMACTokenAuth struct {
+	// Key is the secret the tokens are signed with. Without one, every
+	// request is rejected.
+	Key []byte
+	// QueryParam is the query parameter holding the token. The default is
+	// "token".
+	QueryParam string
+	// CookieName is the cookie holding the token. Cookies are not checked if
+	// it is empty.
+	CookieName string
+}
+
+// tokenPayload is the signed part of a token.
+type tokenPayload struct {
+	Subject string            `json:"sub"`
+	Session string            `json:"sid,omitempty"`
+	Expires int64             `json:"exp,omitempty"`
+	Claims  map[string]string `json:"claims,omitempty"`
+}
+
+// SignToken creates a token for HMACTokenAuth that authenticates p until
+// expires. A zero expires creates a token that does not expire. It returns
+// ErrNoKey if key is empty.
+func SignToken(key []byte, p Principal, expires time.Time) (string, error) {
+	if len(key) == 0 {
+		return "", ErrNoKey
+	}
+	payload := tokenPayload{Subject: p.ID, Session: p.SessionID, Claims: p.Claims}
+	if !expires.IsZero() {
+		payload.Expires = expires.Unix()
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(data) + "." + enc.EncodeToString(signature(key, data)), nil
+}
+
+func signature(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Authenticate implements Authenticator.
+func (a *HMACTokenAuth) Authenticate(r *http.Request) (*Principal, error) {
+	if len(a.Key) == 0 {
+		// Anyone could sign tokens with an empty key.
+		return nil, ErrNoKey
+	}
+	token := a.token(r)
+	if token == "" {
+		return nil, ErrUnauthorized
+	}
+
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	enc := base64.RawURLEncoding
+	data, err := enc.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac, err := enc.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, signature(a.Key, data)) {
+		return nil, ErrInvalidToken
+	}
+
+	var payload tokenPayload
+	if err := json.Unmarshal(data, &payload); err != nil || payload.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	if payload.Expires != 0 && time.Now().Unix() >= payload.Expires {
+		return nil, ErrTokenExpired
+	}
+
+	return &Principal{ID: payload.Subject, SessionID: payload.Session, Claims: payload.Claims}, nil
+}
+
+// Challenge implements Challenger.
+func (a *HMACTokenAuth) Challenge() string {
+	return "Bearer"
+}
+
+// token extracts the token from the request.
+func (a *HMACTokenAuth) token(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	if a.CookieName != "" {
+		if c, err := r.Cookie(a.CookieName); err == nil {
+			return c.Value
+		}
+	}
+
+	param := a.QueryParam
+	if param == "" {
+		param = "token"
+	}
+	return r.URL.Query().Get(param)
+}
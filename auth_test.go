@@ -0,0 +1,35 @@
+package eventsource
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHMACTokenAuthRequiresKey(t *testing.T) {
+	p := Principal{ID: "admin"}
+	if _, err := SignToken(nil, p, time.Time{}); err != ErrNoKey {
+		t.Errorf("SignToken without a key: %v, want ErrNoKey", err)
+	}
+
+	// A token signed with an empty key by other means.
+	token := "eyJzdWIiOiJhZG1pbiJ9.a5c_lxV_whNCUDj6la4V42IAB4KKLXrzynLNCmtm0o4"
+	for _, key := range [][]byte{nil, {}} {
+		r := httptest.NewRequest("GET", "/events", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		auth := &HMACTokenAuth{Key: key}
+		if p, err := auth.Authenticate(r); err != ErrNoKey || p != nil {
+			t.Errorf("key %q: authenticated %v, %v", key, p, err)
+		}
+	}
+
+	key := []byte("secret")
+	signed, err := SignToken(key, p, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/events?token="+signed, nil)
+	if got, err := (&HMACTokenAuth{Key: key}).Authenticate(r); err != nil || got.ID != "admin" {
+		t.Errorf("valid token: %v, %v", got, err)
+	}
+}
@@ -0,0 +1,229 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Broker routes events to clients by named topic. Clients choose their
+// topics when they connect, with "?topic=a&topic=b" or a {topic} path
+// wildcard, and producers call Publish. Delivery goes through a
+// ConnectionManager, so its send queues and ID generator apply, but only
+// the subscribers of a topic are visited.
+//
+// Each topic may keep its own history, see SetStoreFactory. Replay after a
+// reconnect is exact for clients subscribed to a single topic. Clients
+// subscribed to several topics are replayed from the topics whose history
+// holds their Last-Event-ID, or an ID after it, in ID order, and sent a
+// HistoryExpiredEvent for each of the others. This relies on IDs that are
+// unique across topics and ordered as published, so the manager needs an
+// IDGenerator; NewBroker installs one if it has none.
+type Broker struct {
+	manager *ConnectionManager
+
+	mu       sync.RWMutex
+	topics   map[string]*topic
+	newStore func(topic string) EventStore
+
+	// TopicsFromRequest extracts the topics a client subscribes to. The
+	// default uses the "topic" query parameters, or else the "topic" path
+	// wildcard.
+	TopicsFromRequest func(r *http.Request) []string
+}
+
+// topic is the state of a single topic.
+type topic struct {
+	subscribers map[*Encoder]struct{}
+	store       EventStore
+	noStore     bool // the store factory returned nil
+}
+
+var errNoTopic = errors.New("no topic")
+
+// NewBroker returns a Broker delivering through manager. If manager has no
+// IDGenerator, it is given a ULIDGenerator: topic stores would otherwise
+// number their events independently, and the same ID would name events of
+// several topics.
+func NewBroker(manager *ConnectionManager) *Broker {
+	manager.mu.Lock()
+	if manager.idGen == nil {
+		manager.idGen = &ULIDGenerator{}
+	}
+	manager.mu.Unlock()
+
+	return &Broker{
+		manager: manager,
+		topics:  make(map[string]*topic),
+	}
+}
+
+// SetStoreFactory enables per-topic history. newStore is called once for
+// every topic, when it is first published to, and may return nil to keep no
+// history for that topic. Topics that clients merely subscribe to get no
+// store, so that clients cannot make the broker allocate one per name.
+func (b *Broker) SetStoreFactory(newStore func(topic string) EventStore) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.newStore = newStore
+}
+
+// getTopic returns the named topic, creating it if create is set. It must
+// be called with b.mu locked.
+func (b *Broker) getTopic(name string, create bool) *topic {
+	t, ok := b.topics[name]
+	if ok || !create {
+		return t
+	}
+	t = &topic{subscribers: make(map[*Encoder]struct{})}
+	b.topics[name] = t
+	return t
+}
+
+// Publish records an event in the history of a topic and sends it to the
+// topic's subscribers.
+func (b *Broker) Publish(name string, event Event) error {
+	b.mu.Lock()
+	t := b.getTopic(name, b.newStore != nil)
+	if t != nil && t.store == nil && !t.noStore && b.newStore != nil {
+		t.store = b.newStore(name)
+		t.noStore = t.store == nil
+	}
+	b.mu.Unlock()
+
+	if t == nil {
+		// Nobody subscribed and no history to keep.
+		return nil
+	}
+
+	_, err := b.manager.publish(event, t.store, func(yield func(*Encoder, *connection)) {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		for encoder := range t.subscribers {
+			if conn, ok := b.manager.encoders[encoder]; ok {
+				yield(encoder, conn)
+			}
+		}
+	})
+	return err
+}
+
+// Subscribers returns the number of clients subscribed to a topic.
+func (b *Broker) Subscribers(name string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if t, ok := b.topics[name]; ok {
+		return len(t.subscribers)
+	}
+	return 0
+}
+
+// Topics returns the names of the known topics in sorted order.
+func (b *Broker) Topics() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	names := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handler returns a Server streaming the topics each client asks for.
+// Requests naming no topic are rejected with 400 Bad Request. h, if not nil,
+// runs for the lifetime of each connection with info.Topics set; otherwise
+// the stream stays open until the client disconnects. opts.Manager is
+// ignored: connections are registered with the Broker's manager.
+func (b *Broker) Handler(h HandlerV3, opts Options) *Server {
+	admit := opts.Admit
+	opts.Admit = func(r *http.Request) (int, http.Header, error) {
+		if len(b.topicsFrom(r)) == 0 {
+			return http.StatusBadRequest, nil, errNoTopic
+		}
+		if admit != nil {
+			return admit(r)
+		}
+		return http.StatusOK, nil, nil
+	}
+	opts.Manager = nil
+
+	return NewServerV3(func(ctx context.Context, info *ConnectionInfo, encoder *Encoder) error {
+		info.Topics = b.topicsFrom(info.Request)
+		err := b.subscribe(encoder, info)
+		defer b.unsubscribe(encoder, info.Topics)
+		if err != nil && IsConnectionError(err) {
+			return err
+		}
+
+		// The manager gave the connection its own context.
+		ctx = info.Context
+		if h == nil {
+			<-ctx.Done()
+			return nil
+		}
+		return h(ctx, info, encoder)
+	}, opts)
+}
+
+// topicsFrom returns the distinct topics requested by r.
+func (b *Broker) topicsFrom(r *http.Request) []string {
+	var names []string
+	if b.TopicsFromRequest != nil {
+		names = b.TopicsFromRequest(r)
+	} else if names = r.URL.Query()["topic"]; len(names) == 0 {
+		if name := r.PathValue("topic"); name != "" {
+			names = []string{name}
+		}
+	}
+
+	seen := make(map[string]bool, len(names))
+	topics := names[:0:0]
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			topics = append(topics, name)
+		}
+	}
+	return topics
+}
+
+// subscribe registers a connection with the manager, replays the history
+// of its topics and adds it to their subscribers.
+func (b *Broker) subscribe(encoder *Encoder, info *ConnectionInfo) error {
+	b.mu.Lock()
+	var stores []topicStore
+	for _, name := range info.Topics {
+		if t, ok := b.topics[name]; ok && t.store != nil {
+			stores = append(stores, topicStore{name, t.store})
+		}
+	}
+	b.mu.Unlock()
+
+	return b.manager.registerAndReplay(encoder, info, stores, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, name := range info.Topics {
+			b.getTopic(name, true).subscribers[encoder] = struct{}{}
+		}
+	})
+}
+
+// unsubscribe removes a connection from its topics and unregisters it.
+// Topics left without subscribers or history are forgotten.
+func (b *Broker) unsubscribe(encoder *Encoder, names []string) {
+	b.mu.Lock()
+	for _, name := range names {
+		if t, ok := b.topics[name]; ok {
+			delete(t.subscribers, encoder)
+			if len(t.subscribers) == 0 && t.store == nil {
+				delete(b.topics, name)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	b.manager.Unregister(encoder)
+}
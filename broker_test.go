@@ -0,0 +1,84 @@
+package eventsource
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestBrokerTopicsFromClients subscribes to topics nobody publishes to:
+// they must not get a store, and must be forgotten once unsubscribed.
+func TestBrokerTopicsFromClients(t *testing.T) {
+	var stores int
+	b := NewBroker(NewConnectionManager())
+	b.SetStoreFactory(func(string) EventStore {
+		stores++
+		return NewMemoryStore(10)
+	})
+
+	enc := NewEncoder(&bytes.Buffer{})
+	info := &ConnectionInfo{Topics: []string{"x1", "x2", "x3"}, LastID: "1"}
+	if err := b.subscribe(enc, info); err != nil {
+		t.Fatal(err)
+	}
+	if stores != 0 {
+		t.Errorf("subscribing created %d stores", stores)
+	}
+	b.unsubscribe(enc, info.Topics)
+	if topics := b.Topics(); len(topics) != 0 {
+		t.Errorf("topics %q left after unsubscribing", topics)
+	}
+
+	if err := b.Publish("x1", Event{Data: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if stores != 1 {
+		t.Errorf("publishing created %d stores, want 1", stores)
+	}
+}
+
+// TestBrokerIDsAcrossTopics replays two topics from an ID of one of them:
+// IDs must not repeat across topics, so that each event is sent once.
+func TestBrokerIDsAcrossTopics(t *testing.T) {
+	b := NewBroker(NewConnectionManager())
+	b.SetStoreFactory(func(string) EventStore { return NewMemoryStore(10) })
+
+	ids := make(map[string]bool)
+	publish := func(topic string) string {
+		t.Helper()
+		if err := b.Publish(topic, Event{Data: []byte(topic)}); err != nil {
+			t.Fatal(err)
+		}
+		id := b.topics[topic].store.(headStore).lastID()
+		if ids[id] {
+			t.Fatalf("ID %s used twice", id)
+		}
+		ids[id] = true
+		return id
+	}
+	publish("a")
+	publish("b")
+	lastA := publish("a")
+	publish("b")
+	publish("a")
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	info := &ConnectionInfo{Topics: []string{"a", "b"}, LastID: lastA}
+	if err := b.subscribe(enc, info); err != nil {
+		t.Fatal(err)
+	}
+	defer b.unsubscribe(enc, info.Topics)
+
+	var got string
+	dec := NewDecoder(&buf)
+	for {
+		var e Event
+		if dec.Decode(&e) != nil {
+			break
+		}
+		got += e.Type + ":" + string(e.Data) + " "
+	}
+	if got != "message:b message:a " || info.HistoryExpired {
+		t.Errorf("replayed %q, HistoryExpired %v", got, info.HistoryExpired)
+	}
+}
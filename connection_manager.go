@@ -1,90 +1,810 @@
 package eventsource
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // ConnectionManager manages multiple SSE connections.
 type ConnectionManager struct {
-	mu         sync.RWMutex
-	encoders   map[*Encoder]*ConnectionInfo
-	onConnect  func(*Encoder)
+	mu           sync.RWMutex
+	encoders     map[*Encoder]*connection
+	onConnect    func(*Encoder)
 	onDisconnect func(*Encoder)
+
+	// open holds every connection from registration until its handler
+	// calls Unregister, including those already dropped by the manager.
+	open map[*Encoder]*connection
+
+	queueSize    int
+	queuePolicy  OverflowPolicy
+	queueTimeout time.Duration
+
+	// pubMu orders appending to the store against registering connections
+	// that replay from it, so that replay and live delivery meet without
+	// duplicates or gaps.
+	pubMu sync.Mutex
+	store EventStore
+	idGen IDGenerator
+
+	// subjects indexes the subject patterns connections subscribed to.
+	subjects *subjectNode
+	// tags indexes connections by tag key and value, users and sessions by
+	// ConnectionInfo.UserID and SessionID.
+	tags     map[string]encoderIndex
+	users    encoderIndex
+	sessions encoderIndex
+
+	// ids indexes connections by ConnectionInfo.ID, generated by connIDs.
+	ids     map[string]*Encoder
+	connIDs ULIDGenerator
+
+	// shuttingDown is set by Shutdown; shutdownEvent, if set, is sent to
+	// every connection as it is unregistered from then on.
+	shuttingDown   bool
+	shutdownEvent  *Event
+	shutdownRetry  time.Duration
+	shutdownJitter time.Duration
+}
+
+// encoderIndex maps a key to a set of connections.
+type encoderIndex map[string]map[*Encoder]struct{}
+
+func (idx encoderIndex) add(key string, encoder *Encoder) {
+	set, ok := idx[key]
+	if !ok {
+		set = make(map[*Encoder]struct{})
+		idx[key] = set
+	}
+	set[encoder] = struct{}{}
+}
+
+func (idx encoderIndex) remove(key string, encoder *Encoder) {
+	delete(idx[key], encoder)
+	if len(idx[key]) == 0 {
+		delete(idx, key)
+	}
+}
+
+// connection is a registered connection.
+type connection struct {
+	info  *ConnectionInfo
+	queue *sendQueue // nil when events are written synchronously
+
+	// cancel cancels info.Context; done is closed once the connection is
+	// unregistered, or dropped and no longer written to.
+	cancel   context.CancelCauseFunc
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// patterns are the subject patterns the connection subscribed to.
+	patterns map[string][]string
+	tags     map[string]string
+
+	// While replaying, live events are held back in pending and written
+	// once the replayed history has been sent.
+	mu        sync.Mutex
+	replaying bool
+	pending   []*EncodedEvent
+}
+
+// hold keeps an event back if the connection is still replaying history.
+func (c *connection) hold(encoded *EncodedEvent) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replaying {
+		c.pending = append(c.pending, encoded)
+	}
+	return c.replaying
 }
 
 // NewConnectionManager creates a new connection manager.
 func NewConnectionManager() *ConnectionManager {
 	return &ConnectionManager{
-		encoders: make(map[*Encoder]*ConnectionInfo),
+		encoders: make(map[*Encoder]*connection),
+		open:     make(map[*Encoder]*connection),
+		subjects: newSubjectNode(),
+		tags:     make(map[string]encoderIndex),
+		users:    make(encoderIndex),
+		sessions: make(encoderIndex),
+		ids:      make(map[string]*Encoder),
 	}
 }
 
+// SetSendQueue gives every connection registered from now on a bounded
+// outbound queue of size events, drained by its own writer goroutine, so
+// that a slow client delays neither the publisher nor other clients. policy
+// decides what happens when the queue is full; timeout is only used by
+// BlockTimeout, which disconnects without waiting if it is zero. A size of
+// zero restores synchronous writes.
+func (cm *ConnectionManager) SetSendQueue(size int, policy OverflowPolicy, timeout time.Duration) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.queueSize = size
+	cm.queuePolicy = policy
+	cm.queueTimeout = timeout
+}
+
+// SetStore sets the store that Broadcast records events in, and that
+// RegisterAndReplay replays them from. Events without an ID get one from the
+// store.
+func (cm *ConnectionManager) SetStore(store EventStore) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.store = store
+}
+
+// SetIDGenerator makes the manager assign an ID from gen to every event
+// without one that is recorded in a store, before it is stored. Targeted
+// events, which are not stored, keep no ID. Without a generator, the store
+// assigns IDs.
+func (cm *ConnectionManager) SetIDGenerator(gen IDGenerator) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.idGen = gen
+}
+
 // Register registers a new connection.
 func (cm *ConnectionManager) Register(encoder *Encoder, info *ConnectionInfo) {
+	cm.register(encoder, info, false)
+}
+
+// RegisterAndReplay registers a new connection and sends it the stored
+// events that followed info.LastID before any live event. If that ID is no
+// longer in the store, a HistoryExpiredEvent is sent instead and
+// info.HistoryExpired is set, so the client knows it missed events.
+func (cm *ConnectionManager) RegisterAndReplay(encoder *Encoder, info *ConnectionInfo) error {
+	var stores []topicStore
+	if store := cm.getStore(); store != nil {
+		stores = append(stores, topicStore{store: store})
+	}
+	return cm.registerAndReplay(encoder, info, stores, nil)
+}
+
+// topicStore is the history of a Broker topic, or of the manager if topic
+// is empty.
+type topicStore struct {
+	topic string
+	store EventStore
+}
+
+// registerAndReplay registers a connection and replays the events following
+// info.LastID from stores, merged in ID order. A HistoryExpiredEvent is sent
+// for every store no longer holding that ID. attach, if not nil, is called once the connection
+// is registered, in step with publish.
+func (cm *ConnectionManager) registerAndReplay(encoder *Encoder, info *ConnectionInfo, stores []topicStore, attach func()) error {
+	replaying := len(stores) > 0 && info.LastID != ""
+
+	// Find the history in step with publish, so that it ends where the
+	// events held for the connection begin. Stores that can read it later
+	// do so once pubMu is released.
+	// Expired history is known by then, so info is complete before the
+	// connection becomes visible.
+	cm.pubMu.Lock()
+	var reads []func() ([]Event, error)
+	var notices []Event
+	for _, ts := range stores {
+		if !replaying {
+			break
+		}
+		var read func() ([]Event, error)
+		var err error
+		if ds, ok := ts.store.(deferredStore); ok {
+			read, err = ds.sinceLater(info.LastID)
+		} else {
+			var events []Event
+			events, err = ts.store.Since(info.LastID)
+			read = func() ([]Event, error) { return events, nil }
+		}
+		switch err {
+		case nil:
+			reads = append(reads, read)
+		case ErrHistoryExpired:
+			info.HistoryExpired = true
+			notices = append(notices, expiredNotice(info, ts))
+		default:
+			reads = append(reads, func() ([]Event, error) { return nil, err })
+		}
+	}
+	conn := cm.register(encoder, info, replaying)
+	if attach != nil {
+		attach()
+	}
+	cm.pubMu.Unlock()
+
+	if !replaying {
+		return nil
+	}
+
+	var histories [][]Event
+	var err error
+	for _, read := range reads {
+		events, rerr := read()
+		if rerr == ErrHistoryExpired {
+			// The store dropped the history since it was asked, too late
+			// to tell through info: have the client reconnect instead.
+			rerr = fmt.Errorf("%w: %w", ErrConnectionClosed, rerr)
+		}
+		if rerr != nil {
+			if err == nil {
+				err = rerr
+			}
+			continue
+		}
+		histories = append(histories, events)
+	}
+	for _, notice := range notices {
+		if err != nil {
+			break
+		}
+		err = encoder.Encode(notice)
+	}
+	if err == nil {
+		err = replayMerged(encoder, histories)
+	}
+
+	// Send what was published meanwhile, then switch to live delivery.
+	for {
+		conn.mu.Lock()
+		pending := conn.pending
+		conn.pending = nil
+		if len(pending) == 0 || err != nil {
+			conn.replaying = false
+			conn.mu.Unlock()
+			break
+		}
+		conn.mu.Unlock()
+
+		for _, encoded := range pending {
+			if err = encoder.WriteEncoded(encoded); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil && IsConnectionError(err) {
+		cm.drop(encoder)
+	}
+	return err
+}
+
+// expiredNotice returns the HistoryExpiredEvent telling a client that ts no
+// longer holds info.LastID, and records the topic in info. The event has
+// the ID of the newest stored event, if the store tells it, so that the
+// client does not get the notice again if it reconnects before the next
+// event.
+func expiredNotice(info *ConnectionInfo, ts topicStore) Event {
+	event := Event{Type: HistoryExpiredEvent, Data: []byte(info.LastID)}
+	if ts.topic != "" {
+		info.ExpiredTopics = append(info.ExpiredTopics, ts.topic)
+		event.Data = append(event.Data, "\n"+ts.topic...)
+	}
+	if hs, ok := ts.store.(headStore); ok {
+		event.ID = hs.lastID()
+	}
+	return event
+}
+
+// replayMerged sends the events of several histories, each oldest first,
+// interleaved in ID order.
+func replayMerged(encoder *Encoder, histories [][]Event) error {
+	for {
+		next := -1
+		for i, events := range histories {
+			if len(events) > 0 && (next < 0 || idLess(events[0].ID, histories[next][0].ID)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return nil
+		}
+		if err := encoder.Encode(histories[next][0]); err != nil {
+			return err
+		}
+		histories[next] = histories[next][1:]
+	}
+}
+
+func (cm *ConnectionManager) register(encoder *Encoder, info *ConnectionInfo, replaying bool) *connection {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	cm.encoders[encoder] = info
+	if info.ID == "" {
+		// ULIDs only fail to generate if the system's random source does.
+		info.ID, _ = cm.connIDs.NextID()
+	}
+	if info.ConnectedAt.IsZero() {
+		info.ConnectedAt = time.Now()
+	}
+	if info.Metadata == nil {
+		info.Metadata = new(Metadata)
+	}
+
+	// The connection gets its own context, so that the manager can end its
+	// handler.
+	parent := info.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	var ctx context.Context
+	conn := &connection{info: info, replaying: replaying, done: make(chan struct{})}
+	ctx, conn.cancel = context.WithCancelCause(parent)
+	info.Context = ctx
+	if cm.shuttingDown {
+		conn.cancel(ErrShuttingDown)
+	}
+
+	if cm.queueSize > 0 {
+		conn.queue = newSendQueue(cm.queueSize, cm.queuePolicy, cm.queueTimeout)
+		go conn.queue.run(encoder, func(error) {
+			cm.drop(encoder)
+		})
+	}
+	cm.encoders[encoder] = conn
+	cm.open[encoder] = conn
+	cm.ids[info.ID] = encoder
+	for key, value := range info.Tags {
+		cm.setTag(encoder, conn, key, value)
+	}
+	if info.UserID != "" {
+		cm.users.add(info.UserID, encoder)
+	}
+	if info.SessionID != "" {
+		cm.sessions.add(info.SessionID, encoder)
+	}
 	if cm.onConnect != nil {
 		cm.onConnect(encoder)
 	}
+	return conn
 }
 
-// Unregister removes a connection.
+// Unregister removes a connection. If the connection has a send queue,
+// Unregister waits for its writer goroutine to finish, so the encoder is no
+// longer written to once it returns. During Shutdown, the shutdown event is
+// written to the connection first.
 func (cm *ConnectionManager) Unregister(encoder *Encoder) {
+	cm.mu.Lock()
+	conn, exists := cm.open[encoder]
+	if !exists {
+		cm.mu.Unlock()
+		return
+	}
+	delete(cm.open, encoder)
+	if _, exists := cm.encoders[encoder]; exists {
+		delete(cm.encoders, encoder)
+		cm.unindex(encoder, conn)
+		if cm.onDisconnect != nil {
+			cm.onDisconnect(encoder)
+		}
+	}
+	var final *Event
+	if cm.shuttingDown && cm.shutdownEvent != nil {
+		final = cm.finalEvent()
+	}
+	cm.mu.Unlock()
+
+	if conn.queue != nil {
+		conn.queue.stop()
+		conn.queue.wait()
+	}
+	if final != nil {
+		_ = encoder.Encode(*final)
+	}
+	conn.cancel(ErrConnectionClosed)
+	conn.finish()
+}
+
+// finish closes conn.done, once.
+func (conn *connection) finish() {
+	conn.doneOnce.Do(func() { close(conn.done) })
+}
+
+// release forgets a connection that ended without Unregister, such as one
+// registered without a handler, once its writer goroutine has finished, so
+// that Shutdown does not wait for it. An Unregister call before then waits
+// for the writer as usual. It must be called with cm.mu locked.
+func (cm *ConnectionManager) release(encoder *Encoder, conn *connection) {
+	if conn.queue == nil {
+		delete(cm.open, encoder)
+		conn.finish()
+		return
+	}
+	go func() {
+		conn.queue.wait()
+		cm.mu.Lock()
+		if cm.open[encoder] == conn {
+			delete(cm.open, encoder)
+		}
+		cm.mu.Unlock()
+		conn.finish()
+	}()
+}
+
+// drop removes a failed connection without waiting for its writer
+// goroutine. The handler's own Unregister call, if any, does the waiting.
+func (cm *ConnectionManager) drop(encoder *Encoder) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	if info, exists := cm.encoders[encoder]; exists {
+	if conn, exists := cm.encoders[encoder]; exists {
 		delete(cm.encoders, encoder)
+		cm.unindex(encoder, conn)
+		if conn.queue != nil {
+			conn.queue.stop()
+		}
+		cause := encoder.Err()
+		if cause == nil {
+			cause = ErrConnectionClosed
+		}
+		conn.cancel(cause)
+		cm.release(encoder, conn)
 		if cm.onDisconnect != nil {
 			cm.onDisconnect(encoder)
 		}
-		_ = info // Use info to avoid unused variable warning
 	}
 }
 
-// Broadcast sends an event to all connected clients.
+// Broadcast sends an event to all connected clients. The event is formatted
+// once and the same bytes are written to every connection. If a store is
+// set, the event is recorded in it first.
 func (cm *ConnectionManager) Broadcast(event Event) error {
+	_, err := cm.publish(event, cm.getStore(), cm.matching(nil))
+	return err
+}
+
+// BroadcastTo sends an event to all connections that pass the filter.
+// Targeted events are not recorded in the store.
+func (cm *ConnectionManager) BroadcastTo(event Event, filter func(*ConnectionInfo) bool) error {
+	_, err := cm.publish(event, nil, cm.matching(filter))
+	return err
+}
+
+// Subscribe subscribes a registered connection to subject patterns, see
+// Publish.
+func (cm *ConnectionManager) Subscribe(encoder *Encoder, patterns ...string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	conn, exists := cm.encoders[encoder]
+	if !exists {
+		return ErrNotRegistered
+	}
+	for _, pattern := range patterns {
+		if _, ok := splitSubject(pattern, true); !ok {
+			return ErrInvalidSubject
+		}
+	}
+
+	if conn.patterns == nil {
+		conn.patterns = make(map[string][]string)
+	}
+	for _, pattern := range patterns {
+		tokens, _ := splitSubject(pattern, true)
+		conn.patterns[pattern] = tokens
+		cm.subjects.add(tokens, encoder)
+	}
+	return nil
+}
+
+// Unsubscribe removes subject patterns of a connection. Patterns are
+// removed automatically when the connection is unregistered.
+func (cm *ConnectionManager) Unsubscribe(encoder *Encoder, patterns ...string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	conn, exists := cm.encoders[encoder]
+	if !exists {
+		return
+	}
+	for _, pattern := range patterns {
+		if tokens, ok := conn.patterns[pattern]; ok {
+			delete(conn.patterns, pattern)
+			cm.subjects.remove(tokens, encoder)
+		}
+	}
+}
+
+// unindex removes a connection from the subject, tag, user, session and
+// ID indexes. It must be called with cm.mu locked.
+func (cm *ConnectionManager) unindex(encoder *Encoder, conn *connection) {
+	for _, tokens := range conn.patterns {
+		cm.subjects.remove(tokens, encoder)
+	}
+	conn.patterns = nil
+	for key := range conn.tags {
+		cm.removeTag(encoder, conn, key)
+	}
+	if conn.info.UserID != "" {
+		cm.users.remove(conn.info.UserID, encoder)
+	}
+	if conn.info.SessionID != "" {
+		cm.sessions.remove(conn.info.SessionID, encoder)
+	}
+	if cm.ids[conn.info.ID] == encoder {
+		delete(cm.ids, conn.info.ID)
+	}
+}
+
+// SetTag sets a tag of a registered connection, replacing any previous
+// value of key. Tags given in ConnectionInfo.Tags are set on
+// registration.
+func (cm *ConnectionManager) SetTag(encoder *Encoder, key, value string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	conn, exists := cm.encoders[encoder]
+	if !exists {
+		return ErrNotRegistered
+	}
+	cm.setTag(encoder, conn, key, value)
+	return nil
+}
+
+// RemoveTag removes a tag of a connection.
+func (cm *ConnectionManager) RemoveTag(encoder *Encoder, key string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if conn, exists := cm.encoders[encoder]; exists {
+		cm.removeTag(encoder, conn, key)
+	}
+}
+
+// Tags returns a copy of the tags of a connection.
+func (cm *ConnectionManager) Tags(encoder *Encoder) map[string]string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	tags := make(map[string]string)
+	if conn, exists := cm.encoders[encoder]; exists {
+		for key, value := range conn.tags {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+func (cm *ConnectionManager) setTag(encoder *Encoder, conn *connection, key, value string) {
+	cm.removeTag(encoder, conn, key)
+	if conn.tags == nil {
+		conn.tags = make(map[string]string)
+	}
+	conn.tags[key] = value
+
+	values, ok := cm.tags[key]
+	if !ok {
+		values = make(encoderIndex)
+		cm.tags[key] = values
+	}
+	values.add(value, encoder)
+}
+
+func (cm *ConnectionManager) removeTag(encoder *Encoder, conn *connection, key string) {
+	value, ok := conn.tags[key]
+	if !ok {
+		return
+	}
+	delete(conn.tags, key)
+
+	values := cm.tags[key]
+	values.remove(value, encoder)
+	if len(values) == 0 {
+		delete(cm.tags, key)
+	}
+}
+
+// BroadcastToTag sends an event to the connections whose tag key has
+// the given value. Unlike BroadcastTo, only the matching connections are
+// visited. Targeted events are not recorded in the store.
+func (cm *ConnectionManager) BroadcastToTag(event Event, key, value string) error {
+	_, err := cm.publish(event, nil, cm.indexed(func() encoderIndex { return cm.tags[key] }, value))
+	return err
+}
+
+// SendToUser sends an event to every live connection of a user, see
+// ConnectionInfo.UserID. It returns the number of connections the event was
+// written or queued to, which is zero if the user has no open stream or the
+// event was dropped from every full queue, see DropNewest.
+func (cm *ConnectionManager) SendToUser(userID string, event Event) (int, error) {
+	return cm.publish(event, nil, cm.indexed(func() encoderIndex { return cm.users }, userID))
+}
+
+// SendToSession sends an event to every live connection of a login session,
+// see ConnectionInfo.SessionID. It returns the number of connections the
+// event was written or queued to.
+func (cm *ConnectionManager) SendToSession(sessionID string, event Event) (int, error) {
+	return cm.publish(event, nil, cm.indexed(func() encoderIndex { return cm.sessions }, sessionID))
+}
+
+// Get returns the info of the connection with the given ID.
+func (cm *ConnectionManager) Get(id string) (*ConnectionInfo, bool) {
 	cm.mu.RLock()
-	encoders := make([]*Encoder, 0, len(cm.encoders))
-	for encoder := range cm.encoders {
-		encoders = append(encoders, encoder)
+	defer cm.mu.RUnlock()
+	if encoder, exists := cm.ids[id]; exists {
+		return cm.encoders[encoder].info, true
 	}
+	return nil, false
+}
+
+// Send sends an event to the connection with the given ID. It returns
+// ErrNotRegistered if there is no such connection.
+func (cm *ConnectionManager) Send(id string, event Event) error {
+	cm.mu.RLock()
+	_, exists := cm.ids[id]
 	cm.mu.RUnlock()
+	if !exists {
+		return ErrNotRegistered
+	}
 
-	var lastErr error
-	for _, encoder := range encoders {
-		if err := encoder.Encode(event); err != nil {
-			// Automatically remove failed connections
-			cm.Unregister(encoder)
-			if IsConnectionError(err) {
-				lastErr = err
+	_, err := cm.publish(event, nil, func(yield func(*Encoder, *connection)) {
+		if encoder, exists := cm.ids[id]; exists {
+			yield(encoder, cm.encoders[encoder])
+		}
+	})
+	return err
+}
+
+// Disconnect closes the connection with the given ID, removes it and
+// cancels its context. reason is reported by the connection's Encoder.Err,
+// for example to the OnDisconnect callback, and by context.Cause; if nil,
+// ErrDisconnected is used.
+func (cm *ConnectionManager) Disconnect(id string, reason error) error {
+	cm.mu.RLock()
+	encoder, exists := cm.ids[id]
+	cm.mu.RUnlock()
+	if !exists {
+		return ErrNotRegistered
+	}
+
+	if reason == nil {
+		reason = ErrDisconnected
+	}
+	encoder.closeWith(reason)
+	cm.drop(encoder)
+	return nil
+}
+
+// indexed selects the connections stored under key in an index. The index
+// is looked up on selection, when cm.mu is held.
+func (cm *ConnectionManager) indexed(index func() encoderIndex, key string) targets {
+	return func(yield func(*Encoder, *connection)) {
+		for encoder := range index()[key] {
+			yield(encoder, cm.encoders[encoder])
+		}
+	}
+}
+
+// Publish sends an event to the connections subscribed to a pattern
+// matching subject, such as "orders.eu.created". Patterns are dot-separated
+// tokens, where "*" matches exactly one token and "#", allowed only as the
+// last token, matches zero or more, so "orders.*" and "orders.#" both match
+// "orders.created". A connection
+// receives the event once even if several of its patterns match. Subject
+// events are not recorded in the store.
+func (cm *ConnectionManager) Publish(subject string, event Event) error {
+	tokens, ok := splitSubject(subject, false)
+	if !ok {
+		return ErrInvalidSubject
+	}
+	_, err := cm.publish(event, nil, func(yield func(*Encoder, *connection)) {
+		cm.subjects.match(tokens, func(encoder *Encoder) {
+			yield(encoder, cm.encoders[encoder])
+		})
+	})
+	return err
+}
+
+// getStore returns the manager's store.
+func (cm *ConnectionManager) getStore() EventStore {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.store
+}
+
+// targets selects the connections an event is delivered to by calling yield
+// for each. It is called with cm.mu read-locked.
+type targets func(yield func(*Encoder, *connection))
+
+// matching selects the connections that pass filter, or all connections if
+// filter is nil.
+func (cm *ConnectionManager) matching(filter func(*ConnectionInfo) bool) targets {
+	return func(yield func(*Encoder, *connection)) {
+		for encoder, conn := range cm.encoders {
+			if filter == nil || filter(conn.info) {
+				yield(encoder, conn)
 			}
 		}
 	}
-	return lastErr
 }
 
-// BroadcastTo sends an event to all connections that pass the filter.
-func (cm *ConnectionManager) BroadcastTo(event Event, filter func(*ConnectionInfo) bool) error {
+// publish records an event in store, if not nil, and delivers it to the
+// selected connections. It returns the number of connections the event was
+// written or queued to.
+func (cm *ConnectionManager) publish(event Event, store EventStore, selected targets) (int, error) {
+	encoded, err := MarshalEvent(event)
+	if err != nil {
+		return 0, err
+	}
+
+	cm.pubMu.Lock()
 	cm.mu.RLock()
-	filtered := make([]*Encoder, 0)
-	for encoder, info := range cm.encoders {
-		if filter(info) {
-			filtered = append(filtered, encoder)
+	gen := cm.idGen
+	cm.mu.RUnlock()
+
+	// IDs are assigned under pubMu, so they reach the store in order. Only
+	// stored events get one: a client resuming from an ID the store never
+	// saw could not be replayed.
+	id := event.ID
+	if gen != nil && store != nil && event.ID == "" && !event.ResetID {
+		if event.ID, err = gen.NextID(); err != nil {
+			cm.pubMu.Unlock()
+			return 0, err
+		}
+	}
+	if store != nil {
+		if event, err = store.Append(event); err != nil {
+			cm.pubMu.Unlock()
+			return 0, err
 		}
 	}
+	if event.ID != id {
+		if encoded, err = MarshalEvent(event); err != nil {
+			cm.pubMu.Unlock()
+			return 0, err
+		}
+	}
+
+	filtered := make(map[*Encoder]*connection)
+	held := make(map[*Encoder]bool)
+	cm.mu.RLock()
+	selected(func(encoder *Encoder, conn *connection) {
+		if _, seen := filtered[encoder]; seen || held[encoder] {
+			return
+		}
+		if conn.hold(encoded) {
+			held[encoder] = true
+		} else {
+			filtered[encoder] = conn
+		}
+	})
 	cm.mu.RUnlock()
+	cm.pubMu.Unlock()
+
+	delivered, err := cm.deliver(filtered, encoded)
+	return delivered + len(held), err
+}
 
+// deliver writes an event to the given connections, or queues it for those
+// with a send queue. Failed and slow connections are removed.
+func (cm *ConnectionManager) deliver(conns map[*Encoder]*connection, encoded *EncodedEvent) (int, error) {
+	var delivered int
 	var lastErr error
-	for _, encoder := range filtered {
-		if err := encoder.Encode(event); err != nil {
-			cm.Unregister(encoder)
+	for encoder, conn := range conns {
+		if conn.queue != nil {
+			err := conn.queue.push(encoded)
+			if err == errDropped {
+				// The client is still there, but won't get this event.
+				continue
+			}
+			if err != nil {
+				encoder.closeWith(err)
+				cm.drop(encoder)
+				lastErr = err
+				continue
+			}
+			delivered++
+			continue
+		}
+
+		if err := encoder.WriteEncoded(encoded); err != nil {
+			// Automatically remove failed connections
+			cm.drop(encoder)
 			if IsConnectionError(err) {
 				lastErr = err
 			}
+			continue
 		}
+		delivered++
 	}
-	return lastErr
+	return delivered, lastErr
 }
 
 // Count returns the number of active connections.
@@ -99,12 +819,23 @@ func (cm *ConnectionManager) List() []*ConnectionInfo {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 	result := make([]*ConnectionInfo, 0, len(cm.encoders))
-	for _, info := range cm.encoders {
-		result = append(result, info)
+	for _, conn := range cm.encoders {
+		result = append(result, conn.info)
 	}
 	return result
 }
 
+// QueueDepth returns the number of events waiting in the send queue of a
+// connection. It is zero for connections without a queue.
+func (cm *ConnectionManager) QueueDepth(encoder *Encoder) int {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	if conn, exists := cm.encoders[encoder]; exists && conn.queue != nil {
+		return conn.queue.depth()
+	}
+	return 0
+}
+
 // SetOnConnect sets the callback when a connection is established.
 func (cm *ConnectionManager) SetOnConnect(fn func(*Encoder)) {
 	cm.mu.Lock()
@@ -112,19 +843,100 @@ func (cm *ConnectionManager) SetOnConnect(fn func(*Encoder)) {
 	cm.onConnect = fn
 }
 
-// SetOnDisconnect sets the callback when a connection is closed.
+// SetOnDisconnect sets the callback when a connection is closed. For
+// connections dropped because the client stopped reading, Encoder.Err
+// reports the cause.
 func (cm *ConnectionManager) SetOnDisconnect(fn func(*Encoder)) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	cm.onDisconnect = fn
 }
 
-// CloseAll closes all connections.
+// CloseAll closes all connections and cancels their contexts. Unlike
+// Shutdown, it does not wait for their handlers to return.
 func (cm *ConnectionManager) CloseAll() {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	for encoder := range cm.encoders {
+	for encoder, conn := range cm.encoders {
+		if conn.queue != nil {
+			conn.queue.stop()
+		}
 		_ = encoder.Close()
+		conn.cancel(ErrClosed)
+		cm.release(encoder, conn)
 	}
-	cm.encoders = make(map[*Encoder]*ConnectionInfo)
+	cm.encoders = make(map[*Encoder]*connection)
+	cm.subjects = newSubjectNode()
+	cm.tags = make(map[string]encoderIndex)
+	cm.users = make(encoderIndex)
+	cm.sessions = make(encoderIndex)
+	cm.ids = make(map[string]*Encoder)
+}
+
+// SetShutdownEvent sets an event that Shutdown sends to every connection
+// before it is closed, for example to tell clients to reconnect elsewhere.
+// If retry is positive, the event's retry hint is set to a random duration
+// between retry and retry+jitter, so that clients do not all reconnect at
+// the same moment.
+func (cm *ConnectionManager) SetShutdownEvent(event Event, retry, jitter time.Duration) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.shutdownEvent = &event
+	cm.shutdownRetry = retry
+	cm.shutdownJitter = jitter
+}
+
+// finalEvent returns the shutdown event with its jittered retry hint. It
+// must be called with cm.mu locked.
+func (cm *ConnectionManager) finalEvent() *Event {
+	event := *cm.shutdownEvent
+	if cm.shutdownRetry > 0 {
+		retry := cm.shutdownRetry
+		if cm.shutdownJitter > 0 {
+			retry += time.Duration(rand.Int63n(int64(cm.shutdownJitter) + 1))
+		}
+		event.Retry = strconv.FormatInt(retry.Milliseconds(), 10)
+	}
+	return &event
+}
+
+// Shutdown gracefully ends all connections. It cancels the context of every
+// connection, which ends the handlers served by Server, and waits for the
+// connections to be unregistered; each receives the shutdown event, if one
+// is set, on the way. Connections registered during or after Shutdown are
+// cancelled right away. If ctx expires first, Shutdown returns its error.
+func (cm *ConnectionManager) Shutdown(ctx context.Context) error {
+	cm.mu.Lock()
+	cm.shuttingDown = true
+	done := make([]chan struct{}, 0, len(cm.open))
+	for _, conn := range cm.open {
+		conn.cancel(ErrShuttingDown)
+		done = append(done, conn.done)
+	}
+	cm.mu.Unlock()
+
+	for _, ch := range done {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// RegisterOnShutdown makes srv.Shutdown shut the manager down, see
+// Shutdown, which http.Server otherwise waits on forever as event streams
+// never become idle. timeout bounds the wait for handlers; zero means no
+// limit.
+func (cm *ConnectionManager) RegisterOnShutdown(srv *http.Server, timeout time.Duration) {
+	srv.RegisterOnShutdown(func() {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		_ = cm.Shutdown(ctx)
+	})
 }
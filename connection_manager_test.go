@@ -0,0 +1,227 @@
+package eventsource
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+// TestShutdownAfterDrop registers connections without a handler, as with
+// Register and Broadcast, and lets a write fail: Shutdown must not wait for
+// an Unregister call that never comes.
+func TestShutdownAfterDrop(t *testing.T) {
+	for _, queued := range []bool{false, true} {
+		cm := NewConnectionManager()
+		if queued {
+			cm.SetSendQueue(4, DropOldest, 0)
+		}
+		cm.Register(NewEncoder(failingWriter{}), &ConnectionInfo{})
+		_ = cm.Broadcast(Event{Data: []byte("x")})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := cm.Shutdown(ctx); err != nil {
+			t.Errorf("queued %v: Shutdown: %v", queued, err)
+		}
+		cancel()
+	}
+}
+
+// TestReplayTopics replays several topic histories to one connection: they
+// must be merged in ID order, with a HistoryExpiredEvent for the topic not
+// holding the last ID.
+func TestReplayTopics(t *testing.T) {
+	stores := []topicStore{
+		{"a", NewMemoryStore(10)},
+		{"b", NewMemoryStore(10)},
+		{"c", NewMemoryStore(10)},
+	}
+	for _, id := range []string{"1", "3", "10"} {
+		stores[0].store.Append(Event{ID: id, Data: []byte("a")})
+	}
+	for _, id := range []string{"1", "2", "4"} {
+		stores[1].store.Append(Event{ID: id, Data: []byte("b")})
+	}
+
+	var buf bytes.Buffer
+	info := &ConnectionInfo{LastID: "1"}
+	if err := NewConnectionManager().registerAndReplay(NewEncoder(&buf), info, stores, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !info.HistoryExpired || strings.Join(info.ExpiredTopics, ",") != "c" {
+		t.Errorf("HistoryExpired %v, ExpiredTopics %q", info.HistoryExpired, info.ExpiredTopics)
+	}
+
+	var got []string
+	dec := NewDecoder(&buf)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e.Type+"/"+e.ID+"/"+string(e.Data))
+	}
+	want := "history-expired//1\nc message/2/b message/3/a message/4/b message/10/a"
+	if strings.Join(got, " ") != want {
+		t.Errorf("replayed %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+// TestReplayExpired reconnects with an unknown ID while another goroutine
+// reads the connection info, as BroadcastTo filters do. Run it with -race.
+// The HistoryExpiredEvent must resume the client from the newest event.
+func TestReplayExpired(t *testing.T) {
+	cm := NewConnectionManager()
+	store := NewMemoryStore(10)
+	cm.SetStore(store)
+	for i := 0; i < 3; i++ {
+		_ = cm.Broadcast(Event{Data: []byte("x")})
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var seen bool
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = cm.BroadcastTo(Event{Data: []byte("y")}, func(info *ConnectionInfo) bool {
+				seen = seen || info.HistoryExpired
+				return false
+			})
+		}
+	}()
+
+	var buf bytes.Buffer
+	info := &ConnectionInfo{LastID: "unknown"}
+	err := cm.RegisterAndReplay(NewEncoder(&buf), info)
+	close(stop)
+	<-done
+	if err != nil || !info.HistoryExpired {
+		t.Fatalf("err %v, HistoryExpired %v", err, info.HistoryExpired)
+	}
+
+	var e Event
+	if err := NewDecoder(&buf).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != HistoryExpiredEvent || e.ID != "3" || string(e.Data) != "unknown" {
+		t.Fatalf("got %+v, want a HistoryExpiredEvent with ID 3", e)
+	}
+
+	buf.Reset()
+	info = &ConnectionInfo{LastID: e.ID}
+	if err := cm.RegisterAndReplay(NewEncoder(&buf), info); err != nil || info.HistoryExpired || buf.Len() != 0 {
+		t.Errorf("reconnecting from the notice: err %v, HistoryExpired %v, sent %q", err, info.HistoryExpired, buf.Bytes())
+	}
+}
+
+// TestReplayAfterTargeted reconnects a client whose last event was a
+// targeted one: the broadcast it missed must be replayed.
+func TestReplayAfterTargeted(t *testing.T) {
+	cm := NewConnectionManager()
+	cm.SetStore(NewMemoryStore(10))
+	cm.SetIDGenerator(&ULIDGenerator{})
+
+	var buf bytes.Buffer
+	if err := cm.RegisterAndReplay(NewEncoder(&buf), &ConnectionInfo{UserID: "u"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = cm.Broadcast(Event{Data: []byte("first")})
+	if n, err := cm.SendToUser("u", Event{Data: []byte("private")}); n != 1 || err != nil {
+		t.Fatalf("SendToUser: %d, %v", n, err)
+	}
+
+	// The client resumes from the last ID it saw, as browsers do.
+	var lastID string
+	dec := NewDecoder(&buf)
+	for {
+		var e Event
+		if dec.Decode(&e) != nil {
+			break
+		}
+		if e.ID != "" {
+			lastID = e.ID
+		}
+	}
+	_ = cm.Broadcast(Event{Data: []byte("second")})
+
+	buf.Reset()
+	info := &ConnectionInfo{LastID: lastID}
+	if err := cm.RegisterAndReplay(NewEncoder(&buf), info); err != nil {
+		t.Fatal(err)
+	}
+	var e Event
+	if err := NewDecoder(&buf).Decode(&e); err != nil || string(e.Data) != "second" || info.HistoryExpired {
+		t.Errorf("replayed %+v, %v, HistoryExpired %v; want the second broadcast", e, err, info.HistoryExpired)
+	}
+}
+
+// BenchmarkBroadcast sends one event to 10k connections, formatting it per
+// connection with Encode or once with MarshalEvent and WriteEncoded, and
+// through ConnectionManager.Broadcast, which does the latter.
+func BenchmarkBroadcast(b *testing.B) {
+	const connections = 10000
+
+	event := Event{
+		Type: "price",
+		ID:   "1700000000000-000042",
+		Data: []byte("{\"symbol\":\"ACME\",\"price\":101.5}\n{\"symbol\":\"INIT\",\"price\":7.25}"),
+	}
+
+	cm := NewConnectionManager()
+	encoders := make([]*Encoder, connections)
+	for i := range encoders {
+		encoders[i] = NewEncoder(io.Discard)
+		cm.Register(encoders[i], &ConnectionInfo{})
+	}
+
+	b.Run("Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, enc := range encoders {
+				if err := enc.Encode(event); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("WriteEncoded", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encoded, err := MarshalEvent(event)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, enc := range encoders {
+				if err := enc.WriteEncoded(encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Manager", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := cm.Broadcast(event); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
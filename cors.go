@@ -0,0 +1,99 @@
+package eventsource
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS is the cross-origin policy of a Server. Preflight requests are
+// answered by the Server without invoking the handler.
+type CORS struct {
+	// AllowedOrigins lists the origins that may open streams. An entry is
+	// either an exact origin such as "https://app.example.com", a pattern
+	// with one "*" wildcard such as "https://*.example.com", or "*" for any
+	// origin.
+	AllowedOrigins []string
+
+	// AllowCredentials lets browsers send cookies and HTTP authentication.
+	// It does not apply to origins only allowed by "*", which are answered
+	// with a literal "*", so that no website can read a logged-in user's
+	// stream.
+	AllowCredentials bool
+
+	// AllowedHeaders lists request headers allowed in addition to
+	// Last-Event-ID and Cache-Control, which EventSource polyfills send.
+	AllowedHeaders []string
+
+	// ExposedHeaders lists response headers that scripts may read.
+	ExposedHeaders []string
+
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+// allowOrigin reports whether origin is allowed, and whether only by "*".
+func (c *CORS) allowOrigin(origin string) (allowed, wildcard bool) {
+	for _, pattern := range c.AllowedOrigins {
+		switch {
+		case pattern == "*":
+			wildcard = true
+		case pattern == origin:
+			return true, false
+		default:
+			if prefix, suffix, ok := strings.Cut(pattern, "*"); ok &&
+				len(origin) >= len(prefix)+len(suffix) &&
+				strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true, false
+			}
+		}
+	}
+	return wildcard, wildcard
+}
+
+// apply sets the CORS response headers for r. It reports whether r is a
+// preflight request, which has then been answered.
+func (c *CORS) apply(w http.ResponseWriter, r *http.Request) (preflight bool) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+
+	preflight = r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	origin := r.Header.Get("Origin")
+	allowed, wildcard := c.allowOrigin(origin)
+	if origin == "" || !allowed {
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	if wildcard {
+		// Browsers refuse credentialed responses allowing "*".
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if !preflight {
+		if len(c.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", "GET, HEAD")
+	headers := append([]string{"Last-Event-ID", "Cache-Control"}, c.AllowedHeaders...)
+	h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
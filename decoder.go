@@ -8,10 +8,40 @@ import (
 )
 
 // A Decoder reads and decodes EventSource events from an input stream.
+// Lines end at LF or CRLF. Unlike in browsers, a lone CR does not end a line
+// and is kept as data.
 type Decoder struct {
 	r *bufio.Reader
 
 	checkedBOM bool
+
+	// extra enables collecting unknown fields into Event.Extra.
+	extra bool
+
+	// maxLine and maxEvent limit the size of a single line and of all
+	// field values of an event. Zero means no limit.
+	maxLine  int
+	maxEvent int
+
+	// body is the data reader handed out by the last NextEvent call. It is
+	// drained before the next event is read.
+	body *dataReader
+
+	// offset is the number of bytes consumed from the stream.
+	offset int64
+
+	// pendingCR is set when a line chunk ended in '\r' that may still turn
+	// out to be part of a "\r\n" terminator.
+	pendingCR bool
+}
+
+// EventHeader holds the non-data fields of an event returned by NextEvent.
+type EventHeader struct {
+	Type    string
+	ID      string
+	Retry   string
+	ResetID bool
+	Extra   Fields
 }
 
 // NewDecoder returns a new decoder that reads from r.
@@ -19,8 +49,29 @@ func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{r: bufio.NewReader(r)}
 }
 
+// SetExtraFields controls whether fields other than id, retry, event and
+// data are collected into Event.Extra instead of being dropped.
+func (d *Decoder) SetExtraFields(enabled bool) {
+	d.extra = enabled
+}
+
+// SetMaxLineSize limits the length of a single line, terminator excluded.
+// Longer lines make the Decoder fail with ErrLineTooLong. Data read through
+// NextEvent is streamed and not subject to the limit. Zero disables it.
+func (d *Decoder) SetMaxLineSize(n int) {
+	d.maxLine = n
+}
+
+// SetMaxEventSize limits the combined size of the field values of an event
+// read with Decode, or of the fields before the data read with NextEvent.
+// Larger events make Decode fail with ErrEventTooLarge. Zero disables the
+// limit.
+func (d *Decoder) SetMaxEventSize(n int) {
+	d.maxEvent = n
+}
+
 func (d *Decoder) checkBOM() {
-	r, _, err := d.r.ReadRune()
+	r, size, err := d.r.ReadRune()
 
 	if err != nil {
 		// let other other callers handle this
@@ -29,63 +80,68 @@ func (d *Decoder) checkBOM() {
 
 	if r != 0xFEFF { // utf8 byte order mark
 		d.r.UnreadRune()
+	} else {
+		d.offset += int64(size)
 	}
 
 	d.checkedBOM = true
 }
 
 // ReadField reads a single line from the stream and parses it as a field. A
-// complete event is signalled by an empty key and value. The returned error
-// may either be an error from the stream, or an ErrInvalidEncoding if the
-// value is not valid UTF-8.
+// complete event is signalled by an empty key and value; comment lines are
+// skipped. The returned error may either be an error from the stream, io.EOF
+// once the stream is exhausted, ErrLineTooLong if the line exceeds the
+// configured limit, or an ErrInvalidEncoding if the value is not valid UTF-8.
 func (d *Decoder) ReadField() (field string, value []byte, err error) {
 	if !d.checkedBOM {
 		d.checkBOM()
 	}
 
-	// Use ReadBytes instead of ReadLine to handle lines longer than 4096 bytes
-	// ReadBytes will read until '\n' or error, handling arbitrarily long lines
-	line, err := d.r.ReadBytes('\n')
-	if err != nil && err != io.EOF {
-		return "", nil, err
-	}
-
-	// Remove trailing '\n' and '\r' if present
-	buf := bytes.TrimRight(line, "\r\n")
-
-	if len(buf) == 0 {
-		return "", nil, nil
-	}
+	for {
+		chunk, eol, err := d.readChunk()
+		if err != nil {
+			return "", nil, err
+		}
 
-	// Handle comments: lines starting with ':' should be ignored (SSE spec)
-	if len(buf) > 0 && buf[0] == ':' {
-		// This is a comment, return empty field to skip it
-		return "", nil, nil
-	}
+		if eol && len(chunk) == 0 {
+			return "", nil, nil
+		}
 
-	parts := bytes.SplitN(buf, []byte{':'}, 2)
-	field = string(parts[0])
+		// Handle comments: lines starting with ':' should be ignored (SSE spec)
+		if chunk[0] == ':' {
+			if !eol {
+				if err := d.skipLine(); err != nil {
+					return "", nil, err
+				}
+			}
+			continue
+		}
 
-	if len(parts) == 2 {
-		value = parts[1]
-	}
+		line, err := d.readRest(append([]byte(nil), chunk...), eol)
+		if err != nil {
+			return "", nil, err
+		}
 
-	// §7. If value starts with a U+0020 SPACE character, remove it from value.
-	if len(value) > 0 && value[0] == ' ' {
-		value = value[1:]
-	}
+		field, value = splitField(line)
+		if !utf8.ValidString(field) || !utf8.Valid(value) {
+			err = ErrInvalidEncoding
+		}
 
-	if !utf8.ValidString(field) || !utf8.Valid(value) {
-		err = ErrInvalidEncoding
+		return field, value, err
 	}
-
-	return
 }
 
 // Decode reads the next event from its input and stores it in the provided
-// Event pointer.
+// Event pointer. An event with a line over the size limit or a field that is
+// not valid UTF-8 is skipped whole, and ErrLineTooLong or ErrInvalidEncoding
+// returned, so that the next call starts with the following event.
 func (d *Decoder) Decode(e *Event) error {
 	var wroteData bool
+	var size int
+
+	if err := d.discardBody(); err != nil {
+		return err
+	}
 
 	// set default event type
 	e.Type = "message"
@@ -93,6 +149,9 @@ func (d *Decoder) Decode(e *Event) error {
 	for {
 		field, value, err := d.ReadField()
 
+		if err == ErrLineTooLong || err == ErrInvalidEncoding {
+			return d.skipEvent(err)
+		}
 		if err != nil {
 			return err
 		}
@@ -101,6 +160,11 @@ func (d *Decoder) Decode(e *Event) error {
 			break
 		}
 
+		size += len(value)
+		if d.maxEvent > 0 && size > d.maxEvent {
+			return d.skipEvent(ErrEventTooLarge)
+		}
+
 		switch field {
 		case "id":
 			e.ID = string(value)
@@ -118,8 +182,331 @@ func (d *Decoder) Decode(e *Event) error {
 				wroteData = true
 			}
 			e.Data = append(e.Data, value...)
+		default:
+			if d.extra {
+				e.Extra.Add(field, string(value))
+			}
 		}
 	}
 
 	return nil
 }
+
+// skipEvent discards the rest of the current event so that the next Decode
+// starts cleanly, and returns cause unless the stream failed meanwhile.
+func (d *Decoder) skipEvent(cause error) error {
+	for {
+		field, _, err := d.ReadField()
+		switch {
+		case err == nil && len(field) == 0:
+			return cause
+		case err != nil && err != ErrInvalidEncoding && err != ErrLineTooLong:
+			return err
+		}
+	}
+}
+
+// Offset returns the number of bytes consumed from the input so far.
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// NextEvent reads the fields of the next event up to its first data line and
+// returns them together with a reader over the event data. Data lines are
+// joined by '\n' exactly as Decode would join them, but are never held in
+// memory as a whole, which makes NextEvent suitable for very large payloads.
+//
+// The returned reader is valid until the next call to NextEvent or Decode;
+// any unread data is discarded at that point. Fields that follow the first
+// data line of an event are skipped, so producers streaming large payloads
+// should send id, retry and event first, as Encoder does. The data is not
+// validated as UTF-8. An event with a field line over the size limit, or a
+// field before the data that is not valid UTF-8, is skipped, and
+// ErrLineTooLong or ErrInvalidEncoding returned; the event size limit
+// applies to the fields before the data, which are held in memory.
+func (d *Decoder) NextEvent() (EventHeader, io.Reader, error) {
+	h := EventHeader{Type: "message"}
+	var size int
+
+	if err := d.discardBody(); err != nil {
+		return h, nil, err
+	}
+
+	if !d.checkedBOM {
+		d.checkBOM()
+	}
+
+	for {
+		chunk, eol, err := d.readChunk()
+		if err != nil {
+			return h, nil, err
+		}
+
+		if eol && len(chunk) == 0 {
+			// end of event without any data
+			d.body = &dataReader{d: d, eol: true, done: true}
+			return h, d.body, nil
+		}
+
+		if chunk[0] == ':' {
+			if !eol {
+				if err := d.skipLine(); err != nil {
+					return h, nil, err
+				}
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(chunk, ':')
+		if i == 4 && string(chunk[:i]) == "data" {
+			d.body = &dataReader{d: d, buf: chunk[i+1:], eol: eol, skipSpace: true}
+			return h, d.body, nil
+		}
+
+		line, err := d.readRest(append([]byte(nil), chunk...), eol)
+		if err == ErrLineTooLong {
+			return h, nil, d.skipEvent(err)
+		}
+		if err != nil {
+			return h, nil, err
+		}
+
+		field, value := splitField(line)
+		if !utf8.ValidString(field) || !utf8.Valid(value) {
+			return h, nil, d.skipEvent(ErrInvalidEncoding)
+		}
+
+		size += len(value)
+		if d.maxEvent > 0 && size > d.maxEvent {
+			return h, nil, d.skipEvent(ErrEventTooLarge)
+		}
+
+		switch field {
+		case "id":
+			h.ID = string(value)
+			h.ResetID = len(value) == 0
+		case "retry":
+			h.Retry = string(value)
+		case "event":
+			h.Type = string(value)
+		case "data":
+			// "data" without a colon is a data line with an empty value.
+			d.body = &dataReader{d: d, eol: true}
+			return h, d.body, nil
+		default:
+			if d.extra {
+				h.Extra.Add(field, string(value))
+			}
+		}
+	}
+}
+
+// discardBody drains the data reader returned by the previous NextEvent call.
+func (d *Decoder) discardBody() error {
+	if d.body == nil {
+		return nil
+	}
+	body := d.body
+	d.body = nil
+	_, err := io.Copy(io.Discard, body)
+	return err
+}
+
+// readChunk returns the next piece of the current line with the line
+// terminator removed. eol reports whether the chunk ends the line. Lines
+// longer than the read buffer are returned in several chunks, so the
+// returned slice is only valid until the next read.
+func (d *Decoder) readChunk() (chunk []byte, eol bool, err error) {
+	if d.pendingCR {
+		d.pendingCR = false
+		next, err := d.r.Peek(1)
+		switch {
+		case err == io.EOF:
+			return nil, true, nil
+		case err != nil:
+			return nil, true, err
+		case next[0] == '\n':
+			_, _ = d.r.ReadByte()
+			d.offset++
+			return nil, true, nil
+		}
+		return []byte{'\r'}, false, nil
+	}
+
+	line, err := d.r.ReadSlice('\n')
+	d.offset += int64(len(line))
+	switch err {
+	case nil:
+		line = line[:len(line)-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		return line, true, nil
+	case bufio.ErrBufferFull:
+		if n := len(line); line[n-1] == '\r' {
+			d.pendingCR = true
+			line = line[:n-1]
+		}
+		return line, false, nil
+	case io.EOF:
+		if len(line) == 0 {
+			return nil, true, io.EOF
+		}
+		if n := len(line); line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		return line, true, nil
+	default:
+		return nil, true, err
+	}
+}
+
+// readRest appends the remainder of the current line to line. eol reports
+// whether line is already complete.
+func (d *Decoder) readRest(line []byte, eol bool) ([]byte, error) {
+	for {
+		if d.maxLine > 0 && len(line) > d.maxLine {
+			if !eol {
+				if err := d.skipLine(); err != nil {
+					return line, err
+				}
+			}
+			return line, ErrLineTooLong
+		}
+		if eol {
+			return line, nil
+		}
+
+		var chunk []byte
+		var err error
+		if chunk, eol, err = d.readChunk(); err != nil {
+			return line, err
+		}
+		line = append(line, chunk...)
+	}
+}
+
+// skipLine discards the remainder of the current line.
+func (d *Decoder) skipLine() error {
+	for {
+		_, eol, err := d.readChunk()
+		if err != nil || eol {
+			return err
+		}
+	}
+}
+
+// splitField splits a complete line into its field name and value.
+func splitField(line []byte) (field string, value []byte) {
+	parts := bytes.SplitN(line, []byte{':'}, 2)
+	field = string(parts[0])
+
+	if len(parts) == 2 {
+		value = parts[1]
+	}
+
+	// §7. If value starts with a U+0020 SPACE character, remove it from value.
+	if len(value) > 0 && value[0] == ' ' {
+		value = value[1:]
+	}
+
+	return
+}
+
+// dataReader streams the data lines of a single event.
+type dataReader struct {
+	d *Decoder
+
+	buf       []byte // unread part of the current chunk
+	eol       bool   // the current line ends after buf
+	skipSpace bool   // a leading space of the current value is still pending
+	done      bool
+	err       error
+}
+
+func (b *dataReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if b.skipSpace && len(b.buf) > 0 {
+			if b.buf[0] == ' ' {
+				b.buf = b.buf[1:]
+			}
+			b.skipSpace = false
+		}
+
+		if len(b.buf) > 0 {
+			c := copy(p[n:], b.buf)
+			b.buf = b.buf[c:]
+			n += c
+			continue
+		}
+
+		if b.done || b.err != nil {
+			break
+		}
+
+		if n > 0 {
+			// Return what we have before blocking on the stream again.
+			break
+		}
+
+		if !b.eol {
+			b.buf, b.eol, b.err = b.d.readChunk()
+			if b.eol && len(b.buf) == 0 {
+				b.skipSpace = false
+			}
+			continue
+		}
+
+		var found bool
+		if found, b.err = b.nextLine(); b.err == nil && found {
+			p[n] = '\n'
+			n++
+		}
+	}
+
+	if n > 0 {
+		return n, nil
+	}
+	if b.err != nil {
+		if b.err == io.EOF {
+			b.err = io.ErrUnexpectedEOF
+		}
+		return 0, b.err
+	}
+	return 0, io.EOF
+}
+
+// nextLine advances to the next data line of the event, skipping comments
+// and other fields. It reports false once the event is complete.
+func (b *dataReader) nextLine() (bool, error) {
+	d := b.d
+	for {
+		chunk, eol, err := d.readChunk()
+		if err != nil {
+			return false, err
+		}
+
+		if eol && len(chunk) == 0 {
+			b.done = true
+			return false, nil
+		}
+
+		if chunk[0] != ':' {
+			i := bytes.IndexByte(chunk, ':')
+			if i == 4 && string(chunk[:i]) == "data" {
+				b.buf, b.eol, b.skipSpace = chunk[i+1:], eol, true
+				return true, nil
+			}
+			if eol && string(chunk) == "data" {
+				b.buf, b.eol = nil, true
+				return true, nil
+			}
+		}
+
+		if !eol {
+			if err := d.skipLine(); err != nil {
+				return false, err
+			}
+		}
+	}
+}
@@ -3,10 +3,16 @@ package eventsource
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 	"unicode/utf8"
 )
 
@@ -26,27 +32,73 @@ func (noopFlusher) Flush() {}
 // Encoder writes EventSource events to an output stream.
 type Encoder struct {
 	mu      sync.Mutex
+	wmu     sync.Mutex // serializes writes to w
 	w       FlushWriter
 	request *http.Request
 	ctx     context.Context
 	closed  bool
+	err     error // why the encoder was closed, if not by Close
+
+	// flush flushes w and reports errors from the underlying connection.
+	flush func() error
+	// stopWatch stops watching the request context.
+	stopWatch func() bool
+
+	lastWrite    time.Time
+	writeTimeout time.Duration
+	// setDeadline sets a write deadline on the underlying connection. It is
+	// nil if the writer does not support deadlines.
+	setDeadline func(time.Time) error
+	// serverOwned is set for an http.ResponseWriter, which must not be
+	// written to once the handler returns.
+	serverOwned bool
+
+	// idGen assigns IDs to events sent without one.
+	idGen IDGenerator
 }
 
 // NewEncoder returns a new encoder that writes to w.
 func NewEncoder(w io.Writer) *Encoder {
+	enc := &Encoder{}
 	if fw, ok := w.(FlushWriter); ok {
-		return &Encoder{w: fw}
+		enc.w = fw
+	} else {
+		enc.w = noopFlusher{w}
 	}
 
-	return &Encoder{w: noopFlusher{w}}
+	switch fw := w.(type) {
+	case http.ResponseWriter:
+		rc := http.NewResponseController(fw)
+		enc.flush = rc.Flush
+		enc.setDeadline = rc.SetWriteDeadline
+		enc.serverOwned = true
+	case interface{ Flush() error }:
+		enc.flush = fw.Flush
+	default:
+		enc.flush = func() error {
+			enc.w.Flush()
+			return nil
+		}
+	}
+
+	if dw, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok && enc.setDeadline == nil {
+		enc.setDeadline = dw.SetWriteDeadline
+	}
+
+	return enc
 }
 
-// NewEncoderWithRequest returns a new encoder with associated HTTP request and context.
+// NewEncoderWithRequest returns a new encoder with associated HTTP request and
+// context. The encoder closes itself with ErrConnectionClosed as soon as the
+// request context is done, that is when the client goes away.
 func NewEncoderWithRequest(w io.Writer, r *http.Request) *Encoder {
 	enc := NewEncoder(w)
 	enc.request = r
 	if r != nil {
 		enc.ctx = r.Context()
+		enc.stopWatch = context.AfterFunc(enc.ctx, func() {
+			enc.closeWith(ErrConnectionClosed)
+		})
 	}
 	return enc
 }
@@ -54,90 +106,321 @@ func NewEncoderWithRequest(w io.Writer, r *http.Request) *Encoder {
 // Flush sends an empty line to signal event is complete, and flushes the
 // writer.
 func (e *Encoder) Flush() error {
-	_, err := e.w.Write([]byte{'\n'})
-	e.w.Flush()
-	return err
+	return e.write([]byte{'\n'}, true)
 }
 
 // WriteField writes an event field to the connection. If the provided value
-// contains newlines, multiple fields will be emitted. If the returned error is
-// not nil, it will be either ErrInvalidEncoding or an error from the
-// connection.
+// contains newlines, one field is emitted per line, so that the Decoder joins
+// them back into the original value byte for byte, blank lines included.
+// Carriage returns are rejected: browsers end a line at a lone CR as well as
+// at CRLF, so no encoding of one survives the trip to them. If the returned
+// error is not nil, it will be either ErrInvalidEncoding, ErrInvalidValue or
+// an error from the connection.
 func (e *Encoder) WriteField(field string, value []byte) error {
+	var buf bytes.Buffer
+	if err := appendField(&buf, field, value); err != nil {
+		return err
+	}
+	return e.write(buf.Bytes(), false)
+}
+
+// appendField formats a field in wire format, one line per line of value.
+func appendField(buf *bytes.Buffer, field string, value []byte) error {
 	if !utf8.ValidString(field) || !utf8.Valid(value) {
 		return ErrInvalidEncoding
 	}
+	if bytes.IndexByte(value, '\r') >= 0 {
+		return ErrInvalidValue
+	}
 
-	lines := bytes.Split(value, []byte{'\n'})
-	for i, line := range lines {
-		// Skip empty lines except when they're part of multi-line data
-		if len(line) == 0 && i > 0 && i < len(lines)-1 {
-			continue
+	for _, line := range bytes.Split(value, []byte{'\n'}) {
+		buf.WriteString(field)
+		if len(line) > 0 {
+			buf.WriteString(": ")
+			buf.Write(line)
 		}
+		buf.WriteByte('\n')
+	}
 
-		if len(line) > 0 && line[len(line)-1] == '\r' {
-			line = line[:len(line)-1]
+	return nil
+}
+
+// marshalEvent formats a complete event, including the blank line that
+// terminates it. Only the data may span several lines: other values
+// containing a line break would not decode to the same event, and are
+// rejected with ErrInvalidValue.
+func marshalEvent(event Event) ([]byte, error) {
+	for _, f := range event.Extra {
+		if !validExtraField(f.Name) {
+			return nil, ErrInvalidField
 		}
+		if !singleLine(f.Value) {
+			return nil, ErrInvalidValue
+		}
+	}
+	if !singleLine(event.ID) || !singleLine(event.Retry) || !singleLine(event.Type) {
+		return nil, ErrInvalidValue
+	}
 
-		if err := e.writeField(field, line); err != nil {
-			return err
+	var buf bytes.Buffer
+
+	if event.ResetID {
+		// Send "id:" with empty value to reset the last event ID
+		buf.WriteString("id:\n")
+	} else if len(event.ID) > 0 {
+		if err := appendField(&buf, "id", []byte(event.ID)); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	if len(event.Retry) > 0 {
+		if err := appendField(&buf, "retry", []byte(event.Retry)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(event.Type) > 0 {
+		if err := appendField(&buf, "event", []byte(event.Type)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range event.Extra {
+		if err := appendField(&buf, f.Name, []byte(f.Value)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := appendField(&buf, "data", event.Data); err != nil {
+		return nil, err
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
 }
 
-func (e *Encoder) writeField(field string, value []byte) (err error) {
-	if len(value) == 0 {
-		_, err = fmt.Fprintf(e.w, "%s\n", field)
-	} else {
-		_, err = fmt.Fprintf(e.w, "%s: %s\n", field, value)
+// EncodedEvent is an event formatted once by MarshalEvent, so that it can be
+// written to any number of connections without being formatted again.
+type EncodedEvent struct {
+	p []byte
+}
+
+// MarshalEvent validates and formats an event for WriteEncoded.
+func MarshalEvent(event Event) (*EncodedEvent, error) {
+	p, err := marshalEvent(event)
+	if err != nil {
+		return nil, err
 	}
+	return &EncodedEvent{p: p}, nil
+}
+
+// Bytes returns the event in wire format. The slice must not be modified.
+func (ev *EncodedEvent) Bytes() []byte {
+	return ev.p
+}
 
-	return
+// WriteEncoded writes a pre-formatted event to the connection, with the same
+// guarantees as Encode.
+func (e *Encoder) WriteEncoded(ev *EncodedEvent) error {
+	return e.write(ev.p, true)
 }
 
-// Encode writes an event to the connection.
+// Encode writes an event to the connection. The event is formatted up front
+// and written with a single Write and Flush, so concurrent calls never
+// interleave.
 func (e *Encoder) Encode(event Event) error {
-	e.mu.Lock()
-	if e.closed {
-		e.mu.Unlock()
+	if e.IsClosed() {
 		return ErrEncoderClosed
 	}
+
+	e.mu.Lock()
+	gen := e.idGen
 	e.mu.Unlock()
 
-	if event.ResetID {
-		// Send "id:" with empty value to reset the last event ID
-		if _, err := fmt.Fprintf(e.w, "id:\n"); err != nil {
-			return e.handleEncodeError(err)
-		}
-	} else if len(event.ID) > 0 {
-		if err := e.WriteField("id", []byte(event.ID)); err != nil {
-			return e.handleEncodeError(err)
+	if gen != nil && event.ID == "" && !event.ResetID {
+		id, err := gen.NextID()
+		if err != nil {
+			return err
 		}
+		event.ID = id
 	}
 
-	if len(event.Retry) > 0 {
-		if err := e.WriteField("retry", []byte(event.Retry)); err != nil {
-			return e.handleEncodeError(err)
+	p, err := marshalEvent(event)
+	if err != nil {
+		return err
+	}
+
+	return e.write(p, true)
+}
+
+// write writes p to the connection while holding the write lock, and
+// optionally flushes it.
+func (e *Encoder) write(p []byte, flush bool) error {
+	e.wmu.Lock()
+	defer e.wmu.Unlock()
+
+	e.mu.Lock()
+	closed := e.closed
+	timeout := e.writeTimeout
+	e.mu.Unlock()
+
+	if closed {
+		return ErrEncoderClosed
+	}
+
+	if timeout > 0 {
+		if e.setDeadline == nil || e.setDeadline(time.Now().Add(timeout)) != nil {
+			// No deadline support: the writer can't be interrupted, so
+			// give up on it instead. A ResponseWriter can't be left to a
+			// blocked goroutine, as the server finishes the response
+			// once the handler returns; it is written without timeout.
+			e.setDeadline = nil
+			if !e.serverOwned {
+				return e.writeWithTimer(p, flush, timeout)
+			}
+		} else {
+			defer e.setDeadline(time.Time{})
 		}
 	}
 
-	if len(event.Type) > 0 {
-		if err := e.WriteField("event", []byte(event.Type)); err != nil {
+	if _, err := e.w.Write(p); err != nil {
+		return e.handleEncodeError(err)
+	}
+	if flush {
+		if err := e.flushWriter(); err != nil {
 			return e.handleEncodeError(err)
 		}
 	}
 
-	if err := e.WriteField("data", event.Data); err != nil {
-		return e.handleEncodeError(err)
+	e.mu.Lock()
+	e.lastWrite = time.Now()
+	e.mu.Unlock()
+	return nil
+}
+
+// flushWriter flushes the underlying writer. Writers that can't flush are
+// not an error.
+func (e *Encoder) flushWriter() error {
+	if err := e.flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
 	}
+	return nil
+}
+
+// writeWithTimer writes p in a separate goroutine and closes the encoder if
+// that takes longer than timeout. The goroutine keeps running until the
+// blocked write returns.
+func (e *Encoder) writeWithTimer(p []byte, flush bool, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.w.Write(p)
+		if err == nil && flush {
+			err = e.flushWriter()
+		}
+		done <- err
+	}()
 
-	if err := e.Flush(); err != nil {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
 		return e.handleEncodeError(err)
+	case <-timer.C:
+		e.closeWith(ErrWriteTimeout)
+		return ErrWriteTimeout
 	}
+}
 
-	return nil
+// WriteComment writes a comment line, which clients ignore, and flushes it.
+// If text contains newlines, one comment line is written per line.
+func (e *Encoder) WriteComment(text string) error {
+	if !utf8.ValidString(text) {
+		return ErrInvalidEncoding
+	}
+
+	var buf bytes.Buffer
+	for _, line := range strings.Split(text, "\n") {
+		buf.WriteByte(':')
+		if len(line) > 0 {
+			buf.WriteByte(' ')
+			buf.WriteString(line)
+		}
+		buf.WriteByte('\n')
+	}
+	return e.write(buf.Bytes(), true)
+}
+
+// StartHeartbeat writes an empty comment whenever nothing has been written
+// for interval, which keeps clients with an idle timeout connected. The
+// heartbeat ends when the returned function is called, the connection's
+// context is done or a write fails. The returned function waits for the
+// heartbeat goroutine to exit.
+func (e *Encoder) StartHeartbeat(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	ctx := e.Context()
+
+	e.mu.Lock()
+	if e.lastWrite.IsZero() {
+		e.lastWrite = time.Now()
+	}
+	e.mu.Unlock()
+
+	go func() {
+		defer close(exited)
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			e.mu.Lock()
+			idle := time.Since(e.lastWrite)
+			e.mu.Unlock()
+
+			// Events were sent meanwhile: wait until the stream has been
+			// idle for a full interval.
+			if idle < interval {
+				timer.Reset(interval - idle)
+				continue
+			}
+
+			if err := e.WriteComment(""); err != nil {
+				return
+			}
+			timer.Reset(interval)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+		<-exited
+	}
+}
+
+// singleLine reports whether value contains no line break.
+func singleLine(value string) bool {
+	return !strings.ContainsAny(value, "\r\n")
+}
+
+// validExtraField reports whether name can be sent as a custom field.
+func validExtraField(name string) bool {
+	switch name {
+	case "", "id", "retry", "event", "data":
+		return false
+	}
+	// A byte order mark at the start of a stream is dropped by clients.
+	return !strings.ContainsAny(name, ":\r\n") && !strings.HasPrefix(name, "\ufeff")
 }
 
 func (e *Encoder) handleEncodeError(err error) error {
@@ -145,10 +428,19 @@ func (e *Encoder) handleEncodeError(err error) error {
 		return nil
 	}
 
+	// A missed write deadline means the client isn't reading.
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		e.closeWith(ErrWriteTimeout)
+		return ErrWriteTimeout
+	}
+
 	// Check if this is a connection error
-	if err == io.EOF || err == io.ErrClosedPipe {
+	if isClosedConnError(err) {
 		e.mu.Lock()
 		e.closed = true
+		if e.err == nil {
+			e.err = ErrConnectionClosed
+		}
 		e.mu.Unlock()
 		return ErrConnectionClosed
 	}
@@ -156,24 +448,45 @@ func (e *Encoder) handleEncodeError(err error) error {
 	return err
 }
 
+// isClosedConnError reports whether err means the client is gone.
+func isClosedConnError(err error) bool {
+	return err == io.EOF ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, http.ErrHandlerTimeout) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// SetIDGenerator makes Encode assign an ID from gen to events sent without
+// one. Events written with WriteEncoded are not changed.
+func (e *Encoder) SetIDGenerator(gen IDGenerator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.idGen = gen
+}
+
+// SetWriteTimeout limits how long writing and flushing a single event may
+// take. When a write misses the deadline, the encoder is closed and the
+// write fails with ErrWriteTimeout. Zero disables the timeout.
+//
+// An http.ResponseWriter must support write deadlines through
+// http.ResponseController, which wrappers do by implementing Unwrap;
+// otherwise the timeout has no effect. Other writers without a
+// SetWriteDeadline method are written from a separate goroutine that is
+// abandoned on timeout, so they must be owned by the caller.
+func (e *Encoder) SetWriteTimeout(timeout time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writeTimeout = timeout
+}
+
 // SetRetry sets the retry timeout in milliseconds.
 // Automatically sends "retry: <value>\n\n" and flushes.
 func (e *Encoder) SetRetry(milliseconds int) error {
-	e.mu.Lock()
-	if e.closed {
-		e.mu.Unlock()
-		return ErrEncoderClosed
-	}
-	e.mu.Unlock()
-
-	value := []byte(fmt.Sprintf("%d", milliseconds))
-	if err := e.WriteField("retry", value); err != nil {
-		return e.handleEncodeError(err)
-	}
-	if err := e.Flush(); err != nil {
-		return e.handleEncodeError(err)
-	}
-	return nil
+	return e.write([]byte(fmt.Sprintf("retry: %d\n\n", milliseconds)), true)
 }
 
 // Close closes the encoder and the underlying connection.
@@ -186,6 +499,9 @@ func (e *Encoder) Close() error {
 	}
 
 	e.closed = true
+	if e.stopWatch != nil {
+		e.stopWatch()
+	}
 	if e.w != nil {
 		// Close underlying writer if possible
 		if closer, ok := e.w.(io.Closer); ok {
@@ -195,6 +511,26 @@ func (e *Encoder) Close() error {
 	return nil
 }
 
+// closeWith closes the encoder, recording cause as the reason.
+func (e *Encoder) closeWith(cause error) {
+	e.mu.Lock()
+	if !e.closed && e.err == nil {
+		e.err = cause
+	}
+	e.mu.Unlock()
+	_ = e.Close()
+}
+
+// Err returns the reason the encoder was closed: ErrWriteTimeout or
+// ErrSlowConsumer for clients that stopped reading, ErrConnectionClosed if
+// the connection was lost. It returns nil while the encoder is open or if it
+// was closed with Close.
+func (e *Encoder) Err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
 // IsClosed checks if the encoder is closed.
 func (e *Encoder) IsClosed() bool {
 	e.mu.Lock()
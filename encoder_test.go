@@ -0,0 +1,158 @@
+package eventsource
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+)
+
+// roundTrip encodes event and decodes it again.
+func roundTrip(event Event) (Event, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(event); err != nil {
+		return Event{}, err
+	}
+
+	var decoded Event
+	err := NewDecoder(&buf).Decode(&decoded)
+	return decoded, err
+}
+
+func TestDataRoundTrip(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"a",
+		"a\n\nb",
+		"\n",
+		"\n\n",
+		"a\n",
+		"\na",
+		" leading space",
+		"  two spaces",
+		"data: nested",
+		":not a comment",
+		"tab\there",
+		"unicode ✓ ümlaut",
+	} {
+		decoded, err := roundTrip(Event{Data: []byte(data)})
+		if err != nil {
+			t.Fatalf("%q: %v", data, err)
+		}
+		if string(decoded.Data) != data {
+			t.Errorf("%q decoded as %q", data, decoded.Data)
+		}
+	}
+}
+
+func TestDataRoundTripProperty(t *testing.T) {
+	// Build data from pieces that matter to the wire format, so that line
+	// breaks, blank lines and leading spaces are common.
+	pieces := []string{"\n", "\n\n", " ", ":", "\r", "a", "data", "é", "\xff"}
+	property := func(picks []uint8) bool {
+		var data []byte
+		for _, p := range picks {
+			data = append(data, pieces[int(p)%len(pieces)]...)
+		}
+		decoded, err := roundTrip(Event{Data: data})
+		if !utf8.Valid(data) {
+			return err == ErrInvalidEncoding
+		}
+		if bytes.IndexByte(data, '\r') >= 0 {
+			return err == ErrInvalidValue
+		}
+		return err == nil && bytes.Equal(decoded.Data, data)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeRejectsCarriageReturn(t *testing.T) {
+	for _, event := range []Event{
+		{Data: []byte("x\r\ny")},
+		{Data: []byte("x\r")},
+		{Data: []byte("\r")},
+		{ID: "a\rb", Data: []byte("x")},
+		{Extra: Fields{{Name: "trace", Value: "a\r"}}},
+	} {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).Encode(event); err != ErrInvalidValue {
+			t.Errorf("%+v: got %v, want ErrInvalidValue", event, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%+v: wrote %q", event, buf.Bytes())
+		}
+	}
+}
+
+// TestConcurrentWrites writes to one Encoder from many goroutines at once.
+// Run it with -race; every event must arrive intact.
+func TestConcurrentWrites(t *testing.T) {
+	const goroutines, events = 8, 200
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	payload := func(id string) []byte {
+		return []byte(strings.Repeat(id+"\n", 5) + id)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				id := fmt.Sprintf("%d-%d", g, i)
+				event := Event{ID: id, Type: "t" + id, Data: payload(id)}
+				var err error
+				switch i % 3 {
+				case 0:
+					err = enc.Encode(event)
+				case 1:
+					var encoded *EncodedEvent
+					if encoded, err = MarshalEvent(event); err == nil {
+						err = enc.WriteEncoded(encoded)
+					}
+				case 2:
+					if err = enc.WriteComment("comment " + id); err == nil {
+						err = enc.Encode(event)
+					}
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	dec := NewDecoder(&buf)
+	for {
+		var e Event
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != "t"+e.ID || !bytes.Equal(e.Data, payload(e.ID)) {
+			t.Fatalf("corrupt event %+v", e)
+		}
+		if seen[e.ID] {
+			t.Fatalf("duplicate event %s", e.ID)
+		}
+		seen[e.ID] = true
+	}
+	if len(seen) != goroutines*events {
+		t.Fatalf("decoded %d events, want %d", len(seen), goroutines*events)
+	}
+}
@@ -20,23 +20,99 @@ var (
 	ErrEncoderClosed    = errors.New("encoder closed")
 	ErrEmptyLine        = errors.New("empty line received")
 	ErrInvalidEncoding  = errors.New("invalid UTF-8 sequence")
+	ErrInvalidField     = errors.New("invalid field name")
+	ErrInvalidValue     = errors.New("invalid field value")
+	ErrLineTooLong      = errors.New("line too long")
+	ErrEventTooLarge    = errors.New("event too large")
+	ErrSlowConsumer     = errors.New("slow consumer")
+	ErrWriteTimeout     = errors.New("write timeout")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrTokenExpired     = errors.New("token expired")
+	ErrNoKey            = errors.New("no signing key")
+	ErrHistoryExpired   = errors.New("event history expired")
+	ErrInvalidSubject   = errors.New("invalid subject")
+	ErrNotRegistered    = errors.New("connection not registered")
+	ErrDisconnected     = errors.New("disconnected")
+	ErrShuttingDown     = errors.New("shutting down")
 )
 
 // IsConnectionError checks if the error is a connection-related error.
 func IsConnectionError(err error) bool {
-	return err == ErrConnectionClosed ||
-		err == ErrEncoderClosed ||
-		err == io.ErrClosedPipe ||
+	return errors.Is(err, ErrConnectionClosed) ||
+		errors.Is(err, ErrEncoderClosed) ||
+		errors.Is(err, ErrWriteTimeout) ||
+		errors.Is(err, ErrSlowConsumer) ||
+		errors.Is(err, io.ErrClosedPipe) ||
 		err == io.EOF
 }
 
 // Event represents a single SSE event.
 type Event struct {
-	Type    string
-	ID      string
-	Retry   string
+	Type  string
+	ID    string
+	Retry string
+	// Data may span several lines separated by '\n'. Carriage returns
+	// cannot be sent, as browsers treat them as line breaks.
 	Data    []byte
 	ResetID bool
+
+	// Extra holds custom fields in stream order. The Encoder writes them
+	// after the standard fields; the Decoder only fills it when enabled with
+	// SetExtraFields.
+	Extra Fields
+}
+
+// Field is a single custom event field.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Fields is an ordered list of custom event fields. A name may occur more
+// than once.
+type Fields []Field
+
+// Add appends a field.
+func (f *Fields) Add(name, value string) {
+	*f = append(*f, Field{Name: name, Value: value})
+}
+
+// Get returns the first value of the named field, or "" if there is none.
+func (f Fields) Get(name string) string {
+	for _, field := range f {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Values returns all values of the named field in order.
+func (f Fields) Values(name string) []string {
+	var values []string
+	for _, field := range f {
+		if field.Name == name {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// EventMeta describes how and when an event was received.
+type EventMeta struct {
+	// ReceivedAt is the time the event was fully decoded.
+	ReceivedAt time.Time
+	// Generation identifies the connection the event arrived on. It starts
+	// at 1 and is incremented on each successful connect.
+	Generation uint64
+	// URL is the URL of the event source.
+	URL string
+	// Offset is the byte offset of the event within the connection's stream.
+	Offset int64
+	// LastEventID is the Last-Event-Id header sent when the connection was
+	// established.
+	LastEventID string
 }
 
 // EventSource reads SSE events from a server with auto-reconnect and callbacks.
@@ -48,11 +124,26 @@ type EventSource struct {
 	dec         *Decoder
 	lastEventID string
 
+	// generation and connLastEventID describe the current connection.
+	generation      uint64
+	connLastEventID string
+
+	// stream is the data reader last returned by ReadStream.
+	stream *streamBody
+
 	// IdleTimeout is the read timeout for idle connections.
 	// It can be set directly, but SetIdleTimeout() is recommended for thread-safe updates.
 	IdleTimeout       time.Duration
 	ConnectionTimeout time.Duration
 
+	// ExtraFields enables collecting custom fields into Event.Extra.
+	ExtraFields bool
+
+	// MaxLineSize and MaxEventSize bound the memory used to decode a single
+	// event, see Decoder.SetMaxLineSize and Decoder.SetMaxEventSize.
+	MaxLineSize  int
+	MaxEventSize int
+
 	transport *http.Transport
 	client    *http.Client
 
@@ -108,6 +199,7 @@ func (es *EventSource) Close() {
 		es.r = nil
 	}
 	es.dec = nil
+	es.stream = nil
 
 	if es.transport != nil {
 		es.transport.CloseIdleConnections()
@@ -135,6 +227,9 @@ func (es *EventSource) connect() bool {
 	lastEventID := es.lastEventID
 	idleTimeout := es.IdleTimeout
 	connectionTimeout := es.ConnectionTimeout
+	extraFields := es.ExtraFields
+	maxLineSize := es.MaxLineSize
+	maxEventSize := es.MaxEventSize
 	es.mu.RUnlock()
 
 	// Check again after releasing lock (double-check pattern)
@@ -231,6 +326,11 @@ func (es *EventSource) connect() bool {
 		timeout: idleTimeout,
 	}
 	es.dec = NewDecoder(es.r)
+	es.dec.SetExtraFields(extraFields)
+	es.dec.SetMaxLineSize(maxLineSize)
+	es.dec.SetMaxEventSize(maxEventSize)
+	es.generation++
+	es.connLastEventID = lastEventID
 	es.mu.Unlock()
 
 	// Call callback outside of lock to avoid potential deadlocks
@@ -245,14 +345,21 @@ func (es *EventSource) connect() bool {
 // Read() is safe to call from multiple goroutines, but each call will
 // read a separate event. For typical use, call Read() from a single goroutine.
 func (es *EventSource) Read() (Event, error) {
+	e, _, err := es.ReadWithMeta()
+	return e, err
+}
+
+// ReadWithMeta is like Read, but also returns metadata describing the
+// connection the event was received on.
+func (es *EventSource) ReadWithMeta() (Event, EventMeta, error) {
 	// Check context cancellation
 	if es.request.Context().Err() != nil {
-		return Event{}, es.request.Context().Err()
+		return Event{}, EventMeta{}, es.request.Context().Err()
 	}
 
 	// connect if need.
 	if !es.connect() {
-		return Event{}, ErrConnectionFailed
+		return Event{}, EventMeta{}, ErrConnectionFailed
 	}
 
 	// read line && decode.
@@ -261,53 +368,159 @@ func (es *EventSource) Read() (Event, error) {
 
 	es.mu.RLock()
 	dec := es.dec
+	meta := EventMeta{
+		Generation:  es.generation,
+		URL:         es.request.URL.String(),
+		LastEventID: es.connLastEventID,
+	}
 	es.mu.RUnlock()
 
 	if dec == nil {
-		return Event{}, ErrConnectionFailed
+		return Event{}, EventMeta{}, ErrConnectionFailed
+	}
+
+	if err := es.finishStream(dec); err != nil {
+		return Event{}, EventMeta{}, es.readError(err)
 	}
 
+	meta.Offset = dec.Offset()
 	err = dec.Decode(&e)
+	meta.ReceivedAt = time.Now()
 
 	// process errors.
 	if err != nil {
-		if err != ErrInvalidEncoding {
-			// treat network errors as disconnect
-			var netErr net.Error
-			if errors.As(err, &netErr) && netErr.Timeout() {
-				err = fmt.Errorf("read timeout: %w", err)
-			}
+		return Event{}, EventMeta{}, es.readError(err)
+	}
 
-			es.mu.Lock()
-			if es.r != nil {
-				_ = es.r.Close()
-			}
-			es.r = nil
-			es.dec = nil
-			es.mu.Unlock()
+	if len(e.Data) == 0 {
+		return Event{}, EventMeta{}, ErrEmptyLine
+	}
 
-			if es.OnDisconnect != nil {
-				es.OnDisconnect(es.request.URL.String(), err)
-			}
-		}
+	es.updateLastEventID(e.ID, e.ResetID)
 
-		return Event{}, err
+	return e, meta, nil
+}
+
+// ReadStream is the streaming counterpart of Read. It returns the header of
+// the next event and a reader over its data, as Decoder.NextEvent does. The
+// reader is valid until the next call to Read or ReadStream; an error while
+// reading it is reported as a disconnect by the following call. The event's
+// ID is only used for reconnecting once its data has been read completely,
+// by the caller or by the following call.
+func (es *EventSource) ReadStream() (EventHeader, io.Reader, error) {
+	// Check context cancellation
+	if es.request.Context().Err() != nil {
+		return EventHeader{}, nil, es.request.Context().Err()
 	}
 
-	if len(e.Data) == 0 {
-		return Event{}, ErrEmptyLine
+	// connect if need.
+	if !es.connect() {
+		return EventHeader{}, nil, ErrConnectionFailed
 	}
 
-	// Update lastEventID: if ResetID is true, clear it; otherwise use the ID if present
+	es.mu.RLock()
+	dec := es.dec
+	es.mu.RUnlock()
+
+	if dec == nil {
+		return EventHeader{}, nil, ErrConnectionFailed
+	}
+
+	if err := es.finishStream(dec); err != nil {
+		return EventHeader{}, nil, es.readError(err)
+	}
+
+	h, body, err := dec.NextEvent()
+	if err != nil {
+		return EventHeader{}, nil, es.readError(err)
+	}
+
+	stream := &streamBody{es: es, dec: dec, r: body, id: h.ID, reset: h.ResetID}
 	es.mu.Lock()
-	if e.ResetID {
-		es.lastEventID = ""
-	} else if len(e.ID) > 0 {
-		es.lastEventID = e.ID
+	es.stream = stream
+	es.mu.Unlock()
+
+	return h, stream, nil
+}
+
+// streamBody is the data reader returned by ReadStream. It records the
+// event's ID once the data has been read to the end.
+type streamBody struct {
+	es    *EventSource
+	dec   *Decoder
+	r     io.Reader
+	id    string
+	reset bool
+	done  bool
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.es.updateLastEventID(b.id, b.reset)
+	}
+	return n, err
+}
+
+// finishStream reads the rest of the data returned by the previous
+// ReadStream call on dec, so that its event ID is recorded before the next
+// event is read.
+func (es *EventSource) finishStream(dec *Decoder) error {
+	es.mu.Lock()
+	stream := es.stream
+	es.stream = nil
+	es.mu.Unlock()
+
+	if stream == nil || stream.dec != dec {
+		return nil
 	}
+	_, err := io.Copy(io.Discard, stream)
+	return err
+}
+
+// readError processes a decoding error. The Decoder skips invalid or
+// oversized events whole, so these are only reported. Anything else is treated as a
+// disconnect: the connection is dropped so that the next read reconnects.
+func (es *EventSource) readError(err error) error {
+	switch err {
+	case ErrInvalidEncoding, ErrLineTooLong, ErrEventTooLarge:
+		// Reconnecting would only have the same event replayed.
+		return err
+	}
+
+	// treat network errors as disconnect
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = fmt.Errorf("read timeout: %w", err)
+	}
+
+	es.mu.Lock()
+	if es.r != nil {
+		_ = es.r.Close()
+	}
+	es.r = nil
+	es.dec = nil
+	es.stream = nil
 	es.mu.Unlock()
 
-	return e, nil
+	if es.OnDisconnect != nil {
+		es.OnDisconnect(es.request.URL.String(), err)
+	}
+
+	return err
+}
+
+// updateLastEventID records the ID of a received event: if reset is true,
+// the ID is cleared; otherwise a non-empty id replaces it.
+func (es *EventSource) updateLastEventID(id string, reset bool) {
+	es.mu.Lock()
+	if reset {
+		es.lastEventID = ""
+	} else if len(id) > 0 {
+		es.lastEventID = id
+	}
+	es.mu.Unlock()
 }
 
 // timeoutReader wraps an io.ReadCloser to enforce a read timeout.
@@ -0,0 +1,473 @@
+package eventsource
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when a FileStore flushes appended events to disk.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncAlways flushes after every append.
+	SyncAlways
+	// SyncInterval flushes on append if the last flush is older than
+	// FileStoreOptions.SyncInterval, and on Close.
+	SyncInterval
+)
+
+// FileStoreOptions configures a FileStore. Zero values select the defaults.
+type FileStoreOptions struct {
+	// SegmentSize is the size in bytes at which a new segment file is
+	// started. The default is 64 MiB.
+	SegmentSize int64
+
+	// Sync is the fsync policy.
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+
+	// Retention limits. Whole segments are removed, oldest first, while the
+	// store holds more than MaxEvents events or MaxBytes bytes, or while the
+	// newest event of the oldest segment is older than MaxAge. The segment
+	// being appended to is never removed. Zero means no limit.
+	MaxEvents int
+	MaxBytes  int64
+	MaxAge    time.Duration
+}
+
+// FileStore is a durable EventStore: an append-only log split into segment
+// files in a directory. The log is scanned on open to rebuild the index
+// from event ID to file offset and to resume ID generation, and a record
+// torn by a crash at the end of the log is truncated. IDs it assigns are
+// decimal sequence numbers, as with MemoryStore.
+type FileStore struct {
+	mu   sync.Mutex
+	dir  string
+	opts FileStoreOptions
+
+	segs   []*segment
+	f      *os.File // the last segment, open for appending
+	next   uint64   // sequence number of the next event
+	last   string   // ID of the newest event
+	index  map[string]location
+	count  int
+	bytes  int64
+	synced time.Time
+}
+
+// segment is a log file holding the events from sequence number first on.
+type segment struct {
+	path     string
+	first    uint64
+	size     int64
+	count    int
+	lastTime time.Time
+	ids      []string
+}
+
+// location is the position of a stored event.
+type location struct {
+	seg *segment
+	off int64
+	seq uint64
+}
+
+// logRecord is the payload of a log record.
+type logRecord struct {
+	Seq   uint64 `json:"seq"`
+	Time  int64  `json:"ts"`
+	Event Event  `json:"event"`
+}
+
+// recordHeaderSize is the size of a record's length and checksum.
+const recordHeaderSize = 8
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// OpenFileStore opens the log in dir, creating the directory if needed.
+func OpenFileStore(dir string, opts FileStoreOptions) (*FileStore, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 64 << 20
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	s := &FileStore{
+		dir:    dir,
+		opts:   opts,
+		index:  make(map[string]location),
+		synced: time.Now(),
+	}
+
+	for i, name := range names {
+		if err := s.loadSegment(name, i == len(names)-1); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.segs) == 0 {
+		if err := s.newSegment(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	last := s.segs[len(s.segs)-1]
+	if s.f, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadSegment scans a segment file and indexes its events. A damaged tail
+// is truncated if the segment is the last one, and an error otherwise.
+func (s *FileStore) loadSegment(path string, last bool) error {
+	first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".log"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("eventsource: unexpected file in event log: %s", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	seg := &segment{path: path, first: first}
+	r := bufio.NewReader(f)
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("eventsource: %s at offset %d: %w", path, seg.size, err)
+			}
+			// A torn write at the end of the log: drop it.
+			if err := os.Truncate(path, seg.size); err != nil {
+				return err
+			}
+			break
+		}
+
+		s.indexRecord(seg, rec, seg.size)
+		seg.size += n
+	}
+
+	if seg.count > 0 || last {
+		if s.next < seg.first {
+			s.next = seg.first
+		}
+		s.segs = append(s.segs, seg)
+		s.bytes += seg.size
+		return nil
+	}
+
+	// An empty segment left behind by a rotation.
+	return os.Remove(path)
+}
+
+// indexRecord adds a record at offset off of seg to the index.
+func (s *FileStore) indexRecord(seg *segment, rec *logRecord, off int64) {
+	if id := rec.Event.ID; id != "" {
+		s.index[id] = location{seg: seg, off: off, seq: rec.Seq}
+		seg.ids = append(seg.ids, id)
+	}
+	seg.count++
+	seg.lastTime = time.Unix(0, rec.Time)
+	s.count++
+	s.next = rec.Seq + 1
+	s.last = rec.Event.ID
+}
+
+// readRecord reads one record and returns it with its size on disk.
+func readRecord(r *bufio.Reader) (*logRecord, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errCorruptRecord
+		}
+		return nil, 0, err
+	}
+
+	// Copy instead of allocating the size up front: a torn header may
+	// claim an absurd size.
+	size := binary.BigEndian.Uint32(header[:4])
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	payload := buf.Bytes()
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorruptRecord
+	}
+
+	var rec logRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	return &rec, recordHeaderSize + int64(size), nil
+}
+
+// newSegment starts a new segment with the next sequence number. The
+// previous segment is synced first: only the last segment may be left with
+// a torn record by a crash.
+func (s *FileStore) newSegment() error {
+	if s.f != nil {
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.log", s.next))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.f != nil {
+		_ = s.f.Close()
+	}
+	s.f = f
+	s.segs = append(s.segs, &segment{path: path, first: s.next})
+	return nil
+}
+
+// Append implements EventStore.
+func (s *FileStore) Append(event Event) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return event, ErrClosed
+	}
+
+	if event.ID == "" && !event.ResetID {
+		event.ID = strconv.FormatUint(s.next+1, 10)
+	}
+
+	rec := &logRecord{Seq: s.next, Time: time.Now().UnixNano(), Event: event}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return event, err
+	}
+
+	frame := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[recordHeaderSize:], payload)
+
+	seg := s.segs[len(s.segs)-1]
+	if seg.count > 0 && seg.size+int64(len(frame)) > s.opts.SegmentSize {
+		if err := s.newSegment(); err != nil {
+			return event, err
+		}
+		seg = s.segs[len(s.segs)-1]
+	}
+
+	if _, err := s.f.Write(frame); err != nil {
+		// Don't leave a partial record in front of the next one.
+		_ = s.f.Truncate(seg.size)
+		return event, err
+	}
+
+	s.indexRecord(seg, rec, seg.size)
+	seg.size += int64(len(frame))
+	s.bytes += int64(len(frame))
+
+	if err := s.sync(false); err != nil {
+		return event, err
+	}
+
+	return event, s.enforceRetention()
+}
+
+// sync flushes the active segment according to the sync policy, or
+// unconditionally if force is set.
+func (s *FileStore) sync(force bool) error {
+	switch {
+	case force, s.opts.Sync == SyncAlways:
+	case s.opts.Sync == SyncInterval && time.Since(s.synced) >= s.opts.SyncInterval:
+	default:
+		return nil
+	}
+	s.synced = time.Now()
+	return s.f.Sync()
+}
+
+// enforceRetention removes the oldest segments while a limit is exceeded.
+func (s *FileStore) enforceRetention() error {
+	for len(s.segs) > 1 {
+		oldest := s.segs[0]
+		switch {
+		case s.opts.MaxEvents > 0 && s.count > s.opts.MaxEvents:
+		case s.opts.MaxBytes > 0 && s.bytes > s.opts.MaxBytes:
+		case s.opts.MaxAge > 0 && time.Since(oldest.lastTime) > s.opts.MaxAge:
+		default:
+			return nil
+		}
+
+		if err := os.Remove(oldest.path); err != nil {
+			return err
+		}
+		for _, id := range oldest.ids {
+			if loc, ok := s.index[id]; ok && loc.seg == oldest {
+				delete(s.index, id)
+			}
+		}
+		s.segs = s.segs[1:]
+		s.count -= oldest.count
+		s.bytes -= oldest.size
+	}
+	return nil
+}
+
+// Since implements EventStore.
+func (s *FileStore) Since(id string) ([]Event, error) {
+	read, err := s.sinceLater(id)
+	if err != nil {
+		return nil, err
+	}
+	return read()
+}
+
+// lastID implements headStore.
+func (s *FileStore) lastID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// seek returns the location of the first stored event whose ID sorts after
+// id, as by idLess, if id sorts between the oldest and the newest stored
+// IDs. It must be called with s.mu locked.
+func (s *FileStore) seek(id string) (location, bool) {
+	after := false
+	for _, seg := range s.segs {
+		i := sort.Search(len(seg.ids), func(i int) bool {
+			return idLess(id, seg.ids[i])
+		})
+		if i < len(seg.ids) {
+			loc, ok := s.index[seg.ids[i]]
+			return loc, ok && (after || i > 0)
+		}
+		after = after || len(seg.ids) > 0
+	}
+	return location{}, false
+}
+
+// segmentRange is the part of a segment file to read events from.
+type segmentRange struct {
+	path     string
+	off, end int64
+}
+
+// sinceLater implements deferredStore. Only the segment list is read under
+// s.mu; the returned function reads the files, up to the sizes they had
+// when sinceLater was called.
+func (s *FileStore) sinceLater(id string) (func() ([]Event, error), error) {
+	s.mu.Lock()
+	loc, ok := s.index[id]
+	from := loc.seq + 1
+	if !ok {
+		if loc, ok = s.seek(id); !ok {
+			s.mu.Unlock()
+			return nil, ErrHistoryExpired
+		}
+		from = loc.seq
+	}
+	var ranges []segmentRange
+	for _, seg := range s.segs {
+		switch {
+		case seg.first < loc.seg.first:
+		case seg == loc.seg:
+			ranges = append(ranges, segmentRange{seg.path, loc.off, seg.size})
+		default:
+			ranges = append(ranges, segmentRange{seg.path, 0, seg.size})
+		}
+	}
+	s.mu.Unlock()
+
+	return func() ([]Event, error) {
+		var events []Event
+		for _, r := range ranges {
+			var err error
+			if events, err = readSegment(r, from, events); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					// Removed by retention in the meantime.
+					return nil, ErrHistoryExpired
+				}
+				return nil, err
+			}
+		}
+		return events, nil
+	}, nil
+}
+
+// readSegment appends the events of r from sequence number from on.
+func readSegment(r segmentRange, from uint64, events []Event) ([]Event, error) {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return events, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(io.NewSectionReader(f, r.off, r.end-r.off))
+	for {
+		rec, _, err := readRecord(br)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		if rec.Seq >= from {
+			events = append(events, rec.Event)
+		}
+	}
+}
+
+// Len returns the number of stored events.
+func (s *FileStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Close flushes and closes the log.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.sync(true)
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,183 @@
+package eventsource
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openFileStore(t *testing.T, dir string, opts FileStoreOptions) *FileStore {
+	t.Helper()
+	s, err := OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func appendEvents(t *testing.T, s *FileStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := s.Append(Event{Data: []byte("payload")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sinceIDs returns the IDs of the events following id.
+func sinceIDs(t *testing.T, s *FileStore, id string) string {
+	t.Helper()
+	events, err := s.Since(id)
+	if err != nil {
+		t.Fatalf("Since(%q): %v", id, err)
+	}
+	var ids string
+	for _, e := range events {
+		ids += e.ID + " "
+	}
+	return ids
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir, FileStoreOptions{SegmentSize: 200})
+	appendEvents(t, s, 5)
+	if n := len(segmentFiles(t, dir)); n < 2 {
+		t.Fatalf("%d segment files, want a rotation", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// IDs resume after the stored events, and history spans segments.
+	s = openFileStore(t, dir, FileStoreOptions{SegmentSize: 200})
+	event, err := s.Append(Event{Data: []byte("payload")})
+	if err != nil || event.ID != "6" {
+		t.Fatalf("appended %q, %v after reopening, want ID 6", event.ID, err)
+	}
+	if ids := sinceIDs(t, s, "1"); ids != "2 3 4 5 6 " {
+		t.Errorf("Since(1) = %q", ids)
+	}
+	if s.Len() != 6 {
+		t.Errorf("Len = %d, want 6", s.Len())
+	}
+}
+
+func TestFileStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir, FileStoreOptions{SegmentSize: 200})
+	appendEvents(t, s, 5)
+	s.Close()
+
+	// Cut the last record short, as a crash during a write would.
+	files := segmentFiles(t, dir)
+	last := files[len(files)-1]
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openFileStore(t, dir, FileStoreOptions{SegmentSize: 200})
+	if s.Len() != 4 {
+		t.Errorf("Len = %d after a torn write, want 4", s.Len())
+	}
+	if _, err := s.Since("5"); err != ErrHistoryExpired {
+		t.Errorf("Since(5) of the torn event: %v, want ErrHistoryExpired", err)
+	}
+	appendEvents(t, s, 1)
+	if ids := sinceIDs(t, s, "3"); ids != "4 5 " {
+		t.Errorf("Since(3) = %q after appending again", ids)
+	}
+}
+
+func TestFileStoreTornSegment(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir, FileStoreOptions{SegmentSize: 200})
+	appendEvents(t, s, 5)
+	s.Close()
+
+	// Damage a segment other than the last: that is not a torn write.
+	first := segmentFiles(t, dir)[0]
+	info, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(first, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileStore(dir, FileStoreOptions{SegmentSize: 200}); err == nil {
+		t.Error("opened a log with a damaged segment")
+	}
+}
+
+func TestFileStoreRetention(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts FileStoreOptions
+	}{
+		{"MaxEvents", FileStoreOptions{MaxEvents: 4}},
+		{"MaxBytes", FileStoreOptions{MaxBytes: 400}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tc.opts.SegmentSize = 200
+			s := openFileStore(t, dir, tc.opts)
+			appendEvents(t, s, 20)
+
+			if n := s.Len(); n == 0 || n > 6 {
+				t.Errorf("Len = %d, want the limit kept within a segment", n)
+			}
+			if _, err := s.Since("1"); err != ErrHistoryExpired {
+				t.Errorf("Since(1): %v, want ErrHistoryExpired", err)
+			}
+			if ids := sinceIDs(t, s, "19"); ids != "20 " {
+				t.Errorf("Since(19) = %q", ids)
+			}
+			if n := len(segmentFiles(t, dir)); n > 4 {
+				t.Errorf("%d segment files left", n)
+			}
+
+			s.Close()
+			s = openFileStore(t, dir, tc.opts)
+			if ids := sinceIDs(t, s, "19"); ids != "20 " {
+				t.Errorf("Since(19) = %q after reopening", ids)
+			}
+		})
+	}
+}
+
+func TestFileStoreMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir, FileStoreOptions{SegmentSize: 1, MaxAge: 50 * time.Millisecond})
+	appendEvents(t, s, 3)
+	time.Sleep(60 * time.Millisecond)
+	appendEvents(t, s, 1)
+
+	// Every event has its own segment; only the active one is kept.
+	if s.Len() != 1 {
+		t.Errorf("Len = %d, want 1", s.Len())
+	}
+	for id := 1; id <= 3; id++ {
+		if _, err := s.Since(strconv.Itoa(id)); err != ErrHistoryExpired {
+			t.Errorf("Since(%d): %v, want ErrHistoryExpired", id, err)
+		}
+	}
+	if n := len(segmentFiles(t, dir)); n != 1 {
+		t.Errorf("%d segment files left, want 1", n)
+	}
+}
@@ -0,0 +1,199 @@
+package eventsource
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// Limits the fuzzed decoders are configured with.
+const (
+	fuzzMaxLine  = 256
+	fuzzMaxEvent = 1024
+)
+
+// FuzzDecode feeds arbitrary streams to Decode and NextEvent. Neither may
+// panic or stop making progress, and decoded events must stay within the
+// configured limits. The seed corpus in testdata/fuzz/FuzzDecode holds
+// streams shaped after real-world servers.
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte("data: a\n:comment\ndata: b\n\n"))
+	f.Add([]byte("data: unterminated"))
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		d := newFuzzDecoder(stream)
+		for i := 0; ; i++ {
+			// Every call consumes at least one byte.
+			if i > len(stream) {
+				t.Fatalf("Decode made no progress after %d calls", i)
+			}
+
+			var e Event
+			err := d.Decode(&e)
+			if err == io.EOF {
+				break
+			}
+			checkDecodeError(t, err)
+			if err != nil {
+				checkSkipped(t, stream, d)
+				continue
+			}
+
+			for _, line := range bytes.Split(e.Data, []byte{'\n'}) {
+				if len(line) > fuzzMaxLine {
+					t.Fatalf("data line of %d bytes exceeds the line limit", len(line))
+				}
+			}
+			if n := len(e.Data) - bytes.Count(e.Data, []byte{'\n'}); n > fuzzMaxEvent {
+				t.Fatalf("%d bytes of data exceed the event limit", n)
+			}
+			checkHeaderSize(t, e.ID, e.Retry, e.Type, e.Extra)
+		}
+
+		d = newFuzzDecoder(stream)
+		for i := 0; ; i++ {
+			if i > len(stream) {
+				t.Fatalf("NextEvent made no progress after %d calls", i)
+			}
+
+			// A stream ending within the data of an event is reported
+			// as truncated.
+			h, body, err := d.NextEvent()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			checkDecodeError(t, err)
+			if err != nil {
+				checkSkipped(t, stream, d)
+				continue
+			}
+
+			checkHeaderSize(t, h.ID, h.Retry, h.Type, h.Extra)
+			if _, err := io.Copy(io.Discard, body); err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatalf("reading data: %v", err)
+			}
+		}
+	})
+}
+
+func newFuzzDecoder(stream []byte) *Decoder {
+	d := NewDecoder(bytes.NewReader(stream))
+	d.SetExtraFields(true)
+	d.SetMaxLineSize(fuzzMaxLine)
+	d.SetMaxEventSize(fuzzMaxEvent)
+	return d
+}
+
+// checkDecodeError fails on errors other than those reported for a single
+// bad event. The input is a bytes.Reader, which only ever returns io.EOF.
+func checkDecodeError(t *testing.T, err error) {
+	t.Helper()
+	switch err {
+	case nil, ErrInvalidEncoding, ErrLineTooLong, ErrEventTooLarge:
+	default:
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// checkSkipped fails unless a bad event was skipped up to the blank line
+// ending it, or to the end of the stream, so that the next event is not
+// decoded from its remains.
+func checkSkipped(t *testing.T, stream []byte, d *Decoder) {
+	t.Helper()
+	if d.Offset() == int64(len(stream)) {
+		return
+	}
+	before := stream[:d.Offset()]
+	if !bytes.HasSuffix(before, []byte{'\n'}) {
+		t.Fatalf("bad event left unread at offset %d", d.Offset())
+	}
+	before = bytes.TrimSuffix(before[:len(before)-1], []byte{'\r'})
+	if len(before) > 0 && !bytes.HasSuffix(before, []byte{'\n'}) && string(before) != "\ufeff" {
+		t.Fatalf("bad event skipped to offset %d, not to its end", d.Offset())
+	}
+}
+
+// checkHeaderSize fails if the non-data fields of an event exceed the
+// configured limits.
+func checkHeaderSize(t *testing.T, id, retry, typ string, extra Fields) {
+	t.Helper()
+	size := len(id) + len(retry)
+	for _, value := range []string{id, retry, typ} {
+		if len(value) > fuzzMaxLine {
+			t.Fatalf("value of %d bytes exceeds the line limit", len(value))
+		}
+	}
+	for _, field := range extra {
+		if len(field.Name)+len(field.Value) > fuzzMaxLine {
+			t.Fatalf("field %q exceeds the line limit", field.Name)
+		}
+		size += len(field.Value)
+	}
+	if size > fuzzMaxEvent {
+		t.Fatalf("%d bytes of fields exceed the event limit", size)
+	}
+}
+
+// FuzzEncodeDecode checks that every event the Encoder accepts is decoded
+// to an identical Event, by Decode and by NextEvent.
+func FuzzEncodeDecode(f *testing.F) {
+	f.Add("", "", "", []byte("a\n\nb"), "", "")
+	f.Add("update", "42", "3000", []byte(" leading space\n"), "trace", " x")
+	f.Add("", "", "", []byte(nil), "\ufefftrace", "")
+
+	f.Fuzz(func(t *testing.T, typ, id, retry string, data []byte, name, value string) {
+		event := Event{Type: typ, ID: id, Retry: retry, Data: data}
+		if name != "" {
+			event.Extra.Add(name, value)
+		}
+
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).Encode(event); err != nil {
+			switch err {
+			case ErrInvalidEncoding, ErrInvalidField, ErrInvalidValue:
+				if buf.Len() != 0 {
+					t.Fatalf("rejected event was written: %q", buf.Bytes())
+				}
+				return
+			}
+			t.Fatal(err)
+		}
+		stream := buf.Bytes()
+
+		want := event
+		if want.Type == "" {
+			want.Type = "message"
+		}
+
+		d := NewDecoder(bytes.NewReader(stream))
+		d.SetExtraFields(true)
+		var got Event
+		if err := d.Decode(&got); err != nil {
+			t.Fatalf("decoding %q: %v", stream, err)
+		}
+		if got.Type != want.Type || got.ID != want.ID || got.Retry != want.Retry ||
+			got.ResetID != want.ResetID || !bytes.Equal(got.Data, want.Data) ||
+			!reflect.DeepEqual(got.Extra, want.Extra) {
+			t.Fatalf("%q decoded as %#v, want %#v", stream, got, want)
+		}
+		if err := d.Decode(&got); err != io.EOF {
+			t.Fatalf("%q: trailing event: %v", stream, err)
+		}
+
+		d = NewDecoder(bytes.NewReader(stream))
+		d.SetExtraFields(true)
+		h, body, err := d.NextEvent()
+		if err != nil {
+			t.Fatalf("streaming %q: %v", stream, err)
+		}
+		streamed, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("streaming %q: %v", stream, err)
+		}
+		if h.Type != want.Type || h.ID != want.ID || h.Retry != want.Retry ||
+			!bytes.Equal(streamed, want.Data) || !reflect.DeepEqual(h.Extra, want.Extra) {
+			t.Fatalf("%q streamed as %#v %q, want %#v", stream, h, streamed, want)
+		}
+	})
+}
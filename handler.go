@@ -2,9 +2,9 @@ package eventsource
 
 import (
 	"context"
-	"mime"
 	"net/http"
-	"strings"
+	"sync"
+	"time"
 )
 
 // ConnectionInfo contains information about the SSE connection.
@@ -12,6 +12,97 @@ type ConnectionInfo struct {
 	Request *http.Request
 	LastID  string
 	Context context.Context
+
+	// ID identifies the connection in a ConnectionManager, see
+	// ConnectionManager.Get. If empty, it is assigned on registration.
+	ID string
+	// ConnectedAt is the time the connection was registered, unless set
+	// before.
+	ConnectedAt time.Time
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string
+	// Metadata holds application data about the connection. It is safe for
+	// concurrent use and shared by copies of the ConnectionInfo. If nil, it
+	// is created on registration.
+	Metadata *Metadata
+
+	// Admission is the result of the Options.Admit stage.
+	Admission Admission
+
+	// Principal is the authenticated client, if Options.Authenticator is
+	// set.
+	Principal *Principal
+
+	// UserID and SessionID identify the user and login session of the
+	// client, across tabs and devices. They are set from the Principal and
+	// indexed by the ConnectionManager, see ConnectionManager.SendToUser.
+	UserID    string
+	SessionID string
+
+	// HistoryExpired is set if the events following LastID could not be
+	// replayed because they are no longer stored. For connections served
+	// by a Broker, ExpiredTopics lists the topics concerned.
+	HistoryExpired bool
+	ExpiredTopics  []string
+
+	// Topics are the topics the client subscribed to, for connections
+	// served by a Broker.
+	Topics []string
+
+	// Tags are indexed by the ConnectionManager on registration, see
+	// ConnectionManager.BroadcastToTag. Later changes are made with
+	// ConnectionManager.SetTag and are not reflected here.
+	Tags map[string]string
+}
+
+// Admission records how a connection was admitted by Options.Admit. It is
+// the zero value if no Admit function is configured.
+type Admission struct {
+	Status int
+	Header http.Header
+}
+
+// Metadata is a key/value map that is safe for concurrent use. The zero
+// value is empty and ready to use.
+type Metadata struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// Get returns the value of key and whether it is set.
+func (m *Metadata) Get(key string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.values[key]
+	return value, ok
+}
+
+// Set sets the value of key.
+func (m *Metadata) Set(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = make(map[string]string)
+	}
+	m.values[key] = value
+}
+
+// Delete removes key.
+func (m *Metadata) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+}
+
+// All returns a copy of all values.
+func (m *Metadata) All() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	values := make(map[string]string, len(m.values))
+	for key, value := range m.values {
+		values[key] = value
+	}
+	return values
 }
 
 // Handler is an adapter for ordinary functions to act as an HTTP handler for
@@ -27,158 +118,68 @@ type Handler func(lastId string, encoder *Encoder, stop <-chan bool)
 // which includes the HTTP request, last event ID, and context.
 type HandlerV2 func(info *ConnectionInfo, encoder *Encoder, stop <-chan bool)
 
-func (h Handler) acceptable(accept string) bool {
-	if accept == "" {
-		// The absense of an Accept header is equivalent to "*/*".
-		// https://tools.ietf.org/html/rfc2296#section-4.2.2
-		return true
+// HandlerV3 is a context-first handler. The context is done when the client
+// disconnects. A returned error ends the stream; with Options.ErrorEvents it
+// is reported to the client as an "error" event first.
+type HandlerV3 func(ctx context.Context, info *ConnectionInfo, encoder *Encoder) error
+
+// WithHeartbeat returns a handler that sends a heartbeat comment whenever the
+// stream has been idle for interval, see Encoder.StartHeartbeat. The
+// heartbeat is stopped when h returns.
+func (h Handler) WithHeartbeat(interval time.Duration) Handler {
+	return func(lastId string, encoder *Encoder, stop <-chan bool) {
+		defer encoder.StartHeartbeat(interval)()
+		h(lastId, encoder, stop)
 	}
+}
 
-	for _, a := range strings.Split(accept, ",") {
-		mediatype, _, err := mime.ParseMediaType(a)
-		if err != nil {
-			continue
-		}
-
-		if mediatype == "text/event-stream" || mediatype == "text/*" || mediatype == "*/*" {
-			return true
-		}
+// WithHeartbeat returns a handler that sends a heartbeat comment whenever the
+// stream has been idle for interval, see Encoder.StartHeartbeat. It can be
+// used with HandlerWithManager as well.
+func (h HandlerV2) WithHeartbeat(interval time.Duration) HandlerV2 {
+	return func(info *ConnectionInfo, encoder *Encoder, stop <-chan bool) {
+		defer encoder.StartHeartbeat(interval)()
+		h(info, encoder, stop)
 	}
-
-	return false
 }
 
 // ServeHTTP calls h with an Encoder and a close notification channel. It
 // performs Content-Type negotiation.
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Vary", "Accept")
-
-	if !h.acceptable(r.Header.Get("Accept")) {
-		w.WriteHeader(http.StatusNotAcceptable)
-		return
-	}
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.WriteHeader(http.StatusOK)
-
-	// Use request context for cancellation instead of deprecated CloseNotifier
-	stop := make(chan bool, 1)
-	go func() {
-		<-r.Context().Done()
-		close(stop)
-	}()
-
-	lastId := r.Header.Get("Last-Event-Id")
-	encoder := NewEncoderWithRequest(w, r)
-	h(lastId, encoder, stop)
+	serve(w, r, &Options{}, HandlerV2(func(info *ConnectionInfo, encoder *Encoder, stop <-chan bool) {
+		h(info.LastID, encoder, stop)
+	}).v3())
 }
 
 // ServeHTTP implements http.Handler for HandlerV2.
 func (h HandlerV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Vary", "Accept")
-
-	// Check Accept header
-	accept := r.Header.Get("Accept")
-	if accept == "" {
-		// The absence of an Accept header is equivalent to "*/*".
-		// https://tools.ietf.org/html/rfc2296#section-4.2.2
-	} else {
-		acceptable := false
-		for _, a := range strings.Split(accept, ",") {
-			mediatype, _, err := mime.ParseMediaType(a)
-			if err != nil {
-				continue
-			}
-
-			if mediatype == "text/event-stream" || mediatype == "text/*" || mediatype == "*/*" {
-				acceptable = true
-				break
-			}
-		}
-		if !acceptable {
-			w.WriteHeader(http.StatusNotAcceptable)
-			return
-		}
-	}
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.WriteHeader(http.StatusOK)
+	serve(w, r, &Options{}, h.v3())
+}
 
-	// Use request context for cancellation
-	stop := make(chan bool, 1)
-	go func() {
-		<-r.Context().Done()
-		close(stop)
-	}()
+// ServeHTTP implements http.Handler for HandlerV3.
+func (h HandlerV3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, &Options{}, h)
+}
 
-	lastId := r.Header.Get("Last-Event-Id")
-	encoder := NewEncoderWithRequest(w, r)
+// v3 adapts h to HandlerV3. The stop channel is closed when the context is
+// done; nothing is left running once h returns.
+func (h HandlerV2) v3() HandlerV3 {
+	return func(ctx context.Context, info *ConnectionInfo, encoder *Encoder) error {
+		stop := make(chan bool)
+		release := context.AfterFunc(ctx, func() {
+			close(stop)
+		})
+		defer release()
 
-	info := &ConnectionInfo{
-		Request: r,
-		LastID:  lastId,
-		Context: r.Context(),
+		h(info, encoder, stop)
+		return nil
 	}
-
-	h(info, encoder, stop)
 }
 
 // HandlerWithManager creates a handler with a connection manager.
 // The manager will automatically register connections when they are established
-// and unregister them when they are closed.
+// and unregister them when they are closed. If the manager has a store, the
+// events the client missed are replayed before the handler is called.
 func HandlerWithManager(manager *ConnectionManager, handler HandlerV2) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Vary", "Accept")
-
-		// Check Accept header
-		accept := r.Header.Get("Accept")
-		if accept == "" {
-			// The absence of an Accept header is equivalent to "*/*".
-			// https://tools.ietf.org/html/rfc2296#section-4.2.2
-		} else {
-			acceptable := false
-			for _, a := range strings.Split(accept, ",") {
-				mediatype, _, err := mime.ParseMediaType(a)
-				if err != nil {
-					continue
-				}
-
-				if mediatype == "text/event-stream" || mediatype == "text/*" || mediatype == "*/*" {
-					acceptable = true
-					break
-				}
-			}
-			if !acceptable {
-				w.WriteHeader(http.StatusNotAcceptable)
-				return
-			}
-		}
-
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.WriteHeader(http.StatusOK)
-
-		// Use request context for cancellation
-		stop := make(chan bool, 1)
-		go func() {
-			<-r.Context().Done()
-			close(stop)
-		}()
-
-		lastId := r.Header.Get("Last-Event-Id")
-		encoder := NewEncoderWithRequest(w, r)
-
-		info := &ConnectionInfo{
-			Request: r,
-			LastID:  lastId,
-			Context: r.Context(),
-		}
-
-		manager.Register(encoder, info)
-		defer manager.Unregister(encoder)
-
-		handler(info, encoder, stop)
-	})
+	return NewServer(handler, Options{Manager: manager})
 }
@@ -0,0 +1,209 @@
+package eventsource
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An IDGenerator produces event IDs for events sent without one. The
+// generators in this package produce IDs that sort lexically in the order
+// they were generated.
+type IDGenerator interface {
+	NextID() (string, error)
+}
+
+// idLess reports whether event ID a sorts before b. Shorter IDs come first,
+// so that the decimal IDs assigned by stores sort numerically, and IDs of
+// the same length, such as those of the IDGenerators in this package,
+// lexically.
+func idLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// CounterGenerator produces zero-padded decimal IDs from a counter that is
+// persisted to a file, so that IDs keep increasing across restarts. The file
+// is only written once per block of IDs; IDs of a block left unused by a
+// restart are skipped.
+type CounterGenerator struct {
+	mu    sync.Mutex
+	path  string
+	block uint64
+	next  uint64
+	limit uint64
+}
+
+// NewCounterGenerator returns a CounterGenerator persisting its counter to
+// path, reserving block IDs per write.
+func NewCounterGenerator(path string, block uint64) (*CounterGenerator, error) {
+	if block == 0 {
+		block = 1
+	}
+
+	g := &CounterGenerator{path: path, block: block}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if g.next, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("eventsource: invalid counter file %s: %w", path, err)
+		}
+	}
+	g.limit = g.next
+	return g, nil
+}
+
+// NextID implements IDGenerator.
+func (g *CounterGenerator) NextID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.next >= g.limit {
+		if err := g.reserve(g.next + g.block); err != nil {
+			return "", err
+		}
+	}
+
+	id := g.next
+	g.next++
+	return fmt.Sprintf("%020d", id), nil
+}
+
+// reserve durably records limit as the first ID of the next run.
+func (g *CounterGenerator) reserve(limit uint64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(g.path), filepath.Base(g.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := fmt.Fprintf(tmp, "%d\n", limit); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), g.path); err != nil {
+		return err
+	}
+
+	g.limit = limit
+	return nil
+}
+
+// TimestampGenerator produces IDs made of the time in milliseconds and a
+// sequence number within that millisecond, such as
+// "1700000000000-000042". If Node is set, it is appended to tell apart the
+// IDs of several producers.
+type TimestampGenerator struct {
+	Node string
+
+	mu   sync.Mutex
+	last int64
+	seq  int
+}
+
+// NextID implements IDGenerator.
+func (g *TimestampGenerator) NextID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Never go back in time, even if the clock does.
+	ms := time.Now().UnixMilli()
+	if ms <= g.last {
+		ms = g.last
+		g.seq++
+		if g.seq > 999999 {
+			ms++
+			g.seq = 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.last = ms
+
+	id := fmt.Sprintf("%013d-%06d", ms, g.seq)
+	if g.Node != "" {
+		id += "-" + g.Node
+	}
+	return id, nil
+}
+
+// ULIDGenerator produces ULIDs: 26 character IDs of a millisecond timestamp
+// and 80 random bits. IDs generated within the same millisecond increment
+// the random part, so they are strictly increasing.
+type ULIDGenerator struct {
+	mu      sync.Mutex
+	last    uint64
+	entropy [10]byte
+}
+
+// NextID implements IDGenerator.
+func (g *ULIDGenerator) NextID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= g.last {
+		ms = g.last
+		if !increment(g.entropy[:]) {
+			// The random part overflowed: borrow the next millisecond.
+			ms++
+			if _, err := io.ReadFull(rand.Reader, g.entropy[:]); err != nil {
+				return "", err
+			}
+		}
+	} else if _, err := io.ReadFull(rand.Reader, g.entropy[:]); err != nil {
+		return "", err
+	}
+	g.last = ms
+
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], ms<<16)
+	copy(id[6:], g.entropy[:])
+	return encodeULID(id), nil
+}
+
+// increment adds one to a big-endian number and reports false on overflow.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeULID encodes 128 bits as 26 Crockford base32 characters.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
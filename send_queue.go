@@ -0,0 +1,127 @@
+package eventsource
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what a connection's send queue does with an event
+// when it is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued event to make room.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the event being sent, which is then not counted
+	// by SendToUser and SendToSession.
+	DropNewest
+	// DisconnectSlow disconnects the client.
+	DisconnectSlow
+	// BlockTimeout waits for room up to the configured timeout, and then
+	// disconnects the client. With a zero timeout it does not wait, and
+	// acts as DisconnectSlow.
+	BlockTimeout
+)
+
+// errDropped is returned by push for an event discarded by DropNewest.
+var errDropped = errors.New("event dropped")
+
+// sendQueue is a bounded queue of events drained by a writer goroutine.
+type sendQueue struct {
+	ch      chan *EncodedEvent
+	done    chan struct{}
+	exited  chan struct{}
+	policy  OverflowPolicy
+	timeout time.Duration
+	once    sync.Once
+}
+
+func newSendQueue(size int, policy OverflowPolicy, timeout time.Duration) *sendQueue {
+	return &sendQueue{
+		ch:      make(chan *EncodedEvent, size),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+		policy:  policy,
+		timeout: timeout,
+	}
+}
+
+// push queues an event, applying the overflow policy if the queue is full.
+// It returns errDropped if the event was discarded, and ErrSlowConsumer if
+// the client should be disconnected.
+func (q *sendQueue) push(ev *EncodedEvent) error {
+	select {
+	case q.ch <- ev:
+		return nil
+	case <-q.done:
+		return ErrEncoderClosed
+	default:
+	}
+
+	switch q.policy {
+	case DropOldest:
+		for {
+			select {
+			case <-q.ch:
+			default:
+			}
+			select {
+			case q.ch <- ev:
+				return nil
+			case <-q.done:
+				return ErrEncoderClosed
+			default:
+			}
+		}
+	case DropNewest:
+		return errDropped
+	case BlockTimeout:
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		select {
+		case q.ch <- ev:
+			return nil
+		case <-q.done:
+			return ErrEncoderClosed
+		case <-timer.C:
+			return ErrSlowConsumer
+		}
+	default:
+		return ErrSlowConsumer
+	}
+}
+
+// run writes queued events to the encoder until the queue is stopped or a
+// write fails, in which case fail is called.
+func (q *sendQueue) run(encoder *Encoder, fail func(error)) {
+	defer close(q.exited)
+	for {
+		select {
+		case <-q.done:
+			return
+		case ev := <-q.ch:
+			if err := encoder.WriteEncoded(ev); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+}
+
+// stop makes the writer goroutine exit after its current write.
+func (q *sendQueue) stop() {
+	q.once.Do(func() {
+		close(q.done)
+	})
+}
+
+// wait blocks until the writer goroutine has exited.
+func (q *sendQueue) wait() {
+	<-q.exited
+}
+
+// depth returns the number of queued events.
+func (q *sendQueue) depth() int {
+	return len(q.ch)
+}
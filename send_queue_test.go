@@ -0,0 +1,188 @@
+package eventsource
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingWriter holds every write until released, and signals entered as
+// the first write starts.
+type blockingWriter struct {
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{entered: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.entered <- struct{}{}:
+	default:
+	}
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *blockingWriter) unblock() {
+	w.once.Do(func() { close(w.release) })
+}
+
+// ids returns the IDs of the events written so far.
+func (w *blockingWriter) ids() string {
+	w.mu.Lock()
+	dec := NewDecoder(bytes.NewReader(w.buf.Bytes()))
+	w.mu.Unlock()
+
+	var ids []byte
+	for {
+		var e Event
+		if dec.Decode(&e) != nil {
+			return string(ids)
+		}
+		ids = append(ids, e.ID...)
+	}
+}
+
+// waitIDs waits for the events with the given IDs to be written.
+func (w *blockingWriter) waitIDs(t *testing.T, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for w.ids() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("wrote events %q, want %q", w.ids(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// stalledQueue registers a connection of user "u" with a queue of two
+// events whose writer is stuck writing event 1.
+func stalledQueue(t *testing.T, policy OverflowPolicy, timeout time.Duration) (*ConnectionManager, *Encoder, *blockingWriter) {
+	t.Helper()
+	cm := NewConnectionManager()
+	cm.SetSendQueue(2, policy, timeout)
+	w := newBlockingWriter()
+	t.Cleanup(w.unblock)
+
+	enc := NewEncoder(w)
+	cm.Register(enc, &ConnectionInfo{UserID: "u"})
+	broadcast(t, cm, 1)
+	<-w.entered
+	return cm, enc, w
+}
+
+func broadcast(t *testing.T, cm *ConnectionManager, id int) {
+	t.Helper()
+	if err := cm.Broadcast(Event{ID: strconv.Itoa(id), Data: []byte("x")}); err != nil {
+		t.Fatalf("event %d: %v", id, err)
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	cm, enc, w := stalledQueue(t, DropOldest, 0)
+	for id := 2; id <= 5; id++ {
+		broadcast(t, cm, id)
+	}
+	if n := cm.QueueDepth(enc); n != 2 {
+		t.Errorf("QueueDepth = %d, want 2", n)
+	}
+	w.unblock()
+	w.waitIDs(t, "145")
+}
+
+func TestSendQueueDropNewest(t *testing.T) {
+	cm, enc, w := stalledQueue(t, DropNewest, 0)
+	for id := 2; id <= 5; id++ {
+		// Events dropped from the full queue are not counted as sent.
+		want := 1
+		if id > 3 {
+			want = 0
+		}
+		n, err := cm.SendToUser("u", Event{ID: strconv.Itoa(id), Data: []byte("x")})
+		if n != want || err != nil {
+			t.Errorf("event %d: sent to %d, %v; want %d", id, n, err, want)
+		}
+	}
+	if n := cm.QueueDepth(enc); n != 2 {
+		t.Errorf("QueueDepth = %d, want 2", n)
+	}
+	w.unblock()
+	w.waitIDs(t, "123")
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		policy  OverflowPolicy
+		timeout time.Duration
+	}{
+		{"DisconnectSlow", DisconnectSlow, 0},
+		{"BlockTimeout", BlockTimeout, 20 * time.Millisecond},
+		{"BlockTimeoutZero", BlockTimeout, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cm, enc, _ := stalledQueue(t, tc.policy, tc.timeout)
+			broadcast(t, cm, 2)
+			broadcast(t, cm, 3)
+
+			start := time.Now()
+			err := cm.Broadcast(Event{ID: "4", Data: []byte("x")})
+			if err != ErrSlowConsumer {
+				t.Fatalf("Broadcast on a full queue: %v, want ErrSlowConsumer", err)
+			}
+			if elapsed := time.Since(start); elapsed < tc.timeout {
+				t.Errorf("disconnected after %v, before the %v timeout", elapsed, tc.timeout)
+			}
+			if enc.Err() != ErrSlowConsumer || cm.Count() != 0 || cm.QueueDepth(enc) != 0 {
+				t.Errorf("Err %v, Count %d: connection not dropped", enc.Err(), cm.Count())
+			}
+		})
+	}
+}
+
+func TestSendQueueBlockTimeoutWaits(t *testing.T) {
+	cm, _, w := stalledQueue(t, BlockTimeout, 5*time.Second)
+	broadcast(t, cm, 2)
+	broadcast(t, cm, 3)
+
+	time.AfterFunc(20*time.Millisecond, w.unblock)
+	broadcast(t, cm, 4)
+	w.waitIDs(t, "1234")
+}
+
+// TestSendQueueUnregisterWaits checks that Unregister returns only once the
+// writer goroutine is done with the encoder.
+func TestSendQueueUnregisterWaits(t *testing.T) {
+	cm, enc, w := stalledQueue(t, DropOldest, 0)
+	broadcast(t, cm, 2)
+
+	unregistered := make(chan struct{})
+	go func() {
+		cm.Unregister(enc)
+		close(unregistered)
+	}()
+	select {
+	case <-unregistered:
+		t.Fatal("Unregister returned while the writer was still writing")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	w.unblock()
+	<-unregistered
+	written := w.ids()
+	time.Sleep(10 * time.Millisecond)
+	if w.ids() != written || written[0] != '1' {
+		t.Errorf("wrote %q after Unregister returned %q", w.ids(), written)
+	}
+}
@@ -0,0 +1,257 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Options configures a Server.
+type Options struct {
+	// Headers are added to every response, after the default headers.
+	Headers http.Header
+
+	// DisableProxyBuffering sends "X-Accel-Buffering: no", which stops nginx
+	// from buffering the stream.
+	DisableProxyBuffering bool
+
+	// CORS, if set, enables cross-origin requests.
+	CORS *CORS
+
+	// Authenticator, if set, must identify the client before a stream is
+	// opened. Its principal is stored in ConnectionInfo and in the request
+	// context, see PrincipalFromContext.
+	Authenticator Authenticator
+
+	// Admit, if set, decides whether a request may open a stream, before any
+	// response is written. Returning a status other than 0 or 200 rejects
+	// the request with that status, for example 401 or 404, or 204 to tell
+	// the client to stop reconnecting; the error, if any, is sent as the
+	// body. An error with a zero status is rejected with 500. The headers
+	// are added to the response either way.
+	Admit func(r *http.Request) (status int, headers http.Header, err error)
+
+	// Manager, if set, has every connection registered while it is open,
+	// after replaying the events the client missed from its store.
+	Manager *ConnectionManager
+
+	// HeartbeatInterval enables heartbeat comments on idle streams, see
+	// Encoder.StartHeartbeat.
+	HeartbeatInterval time.Duration
+
+	// WriteTimeout is applied to every connection's Encoder, see
+	// Encoder.SetWriteTimeout.
+	WriteTimeout time.Duration
+
+	// ErrorEvents reports errors returned by a HandlerV3, and recovered
+	// panics, to the client as an event of type "error" whose data is
+	// {"message": "..."}. Panics are reported as an internal error without
+	// details.
+	ErrorEvents bool
+
+	// ErrorRetry is sent as the retry hint of error events, if positive.
+	ErrorRetry time.Duration
+
+	// ErrorLog logs recovered handler panics. If nil, the log package's
+	// standard logger is used.
+	ErrorLog *log.Logger
+}
+
+// Server is an http.Handler that serves an event stream to each client. It
+// answers GET requests with the stream, HEAD requests with the stream
+// headers only and OPTIONS requests with the allowed methods; other methods
+// are rejected with 405 Method Not Allowed. Panics in the handler are
+// recovered and logged.
+type Server struct {
+	Options
+	handler HandlerV3
+}
+
+// NewServer returns a Server that streams events with handler.
+func NewServer(handler HandlerV2, opts Options) *Server {
+	return &Server{Options: opts, handler: handler.v3()}
+}
+
+// NewServerV3 returns a Server that streams events with a HandlerV3.
+func NewServerV3(handler HandlerV3, opts Options) *Server {
+	return &Server{Options: opts, handler: handler}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, &s.Options, s.handler)
+}
+
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// serve is the single code path behind Server and the handler types.
+func serve(w http.ResponseWriter, r *http.Request, opts *Options, h HandlerV3) {
+	if opts.CORS != nil && opts.CORS.apply(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		w.Header().Set("Allow", allowedMethods)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", allowedMethods)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept")
+
+	if !acceptable(r.Header.Get("Accept")) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	var principal *Principal
+	if opts.Authenticator != nil {
+		var ok bool
+		if r, principal, ok = authenticate(w, r, opts.Authenticator); !ok {
+			return
+		}
+	}
+
+	var admission Admission
+	if opts.Admit != nil {
+		status, headers, err := opts.Admit(r)
+		for key, values := range headers {
+			w.Header()[key] = values
+		}
+		if status == 0 && err != nil {
+			status = http.StatusInternalServerError
+		}
+		if status != 0 && status != http.StatusOK {
+			w.WriteHeader(status)
+			if err != nil && status != http.StatusNoContent {
+				fmt.Fprintln(w, err.Error())
+			}
+			return
+		}
+		admission = Admission{Status: http.StatusOK, Header: headers}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	if opts.DisableProxyBuffering {
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
+	for key, values := range opts.Headers {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Send the headers now, so that the client sees the stream open even if
+	// no event follows for a while.
+	_ = http.NewResponseController(w).Flush()
+
+	lastId := r.Header.Get("Last-Event-Id")
+	encoder := NewEncoderWithRequest(w, r)
+	if opts.WriteTimeout > 0 {
+		encoder.SetWriteTimeout(opts.WriteTimeout)
+	}
+
+	info := &ConnectionInfo{
+		Request:    r,
+		LastID:     lastId,
+		Context:    r.Context(),
+		RemoteAddr: r.RemoteAddr,
+		Metadata:   new(Metadata),
+		Admission:  admission,
+		Principal:  principal,
+	}
+	if principal != nil {
+		info.UserID = principal.ID
+		info.SessionID = principal.SessionID
+	}
+
+	if opts.Manager != nil {
+		err := opts.Manager.RegisterAndReplay(encoder, info)
+		defer opts.Manager.Unregister(encoder)
+		if err != nil && IsConnectionError(err) {
+			return
+		}
+	}
+
+	if opts.HeartbeatInterval > 0 {
+		defer encoder.StartHeartbeat(opts.HeartbeatInterval)()
+	}
+
+	// Errors after the connection was ended, for example by
+	// ConnectionManager.Shutdown, are not reported.
+	err := runHandler(h, opts, info, encoder)
+	if err != nil && opts.ErrorEvents && !IsConnectionError(err) && info.Context.Err() == nil {
+		_ = encoder.Encode(errorEvent(err.Error(), opts.ErrorRetry))
+	}
+}
+
+// runHandler calls h and turns a panic into an error.
+func runHandler(h HandlerV3, opts *Options, info *ConnectionInfo, encoder *Encoder) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			logf := log.Printf
+			if opts.ErrorLog != nil {
+				logf = opts.ErrorLog.Printf
+			}
+			logf("eventsource: panic serving %s: %v\n%s", info.Request.RemoteAddr, p, debug.Stack())
+			err = errInternal
+		}
+	}()
+
+	return h(info.Context, info, encoder)
+}
+
+var errInternal = errors.New("internal server error")
+
+// errorEvent builds the "error" event sent for a failed handler.
+func errorEvent(message string, retry time.Duration) Event {
+	data, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{message})
+
+	e := Event{Type: "error", Data: data}
+	if retry > 0 {
+		e.Retry = fmt.Sprintf("%d", retry.Milliseconds())
+	}
+	return e
+}
+
+// acceptable reports whether the Accept header allows an event stream.
+func acceptable(accept string) bool {
+	if accept == "" {
+		// The absense of an Accept header is equivalent to "*/*".
+		// https://tools.ietf.org/html/rfc2296#section-4.2.2
+		return true
+	}
+
+	for _, a := range strings.Split(accept, ",") {
+		mediatype, _, err := mime.ParseMediaType(a)
+		if err != nil {
+			continue
+		}
+
+		if mediatype == "text/event-stream" || mediatype == "text/*" || mediatype == "*/*" {
+			return true
+		}
+	}
+
+	return false
+}
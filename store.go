@@ -0,0 +1,151 @@
+package eventsource
+
+import (
+	"strconv"
+	"sync"
+)
+
+// HistoryExpiredEvent is the type of the event sent instead of a replay when
+// the client's last event ID is no longer stored. Its data is that ID. For
+// connections served by a Broker, one is sent for every topic whose history
+// lacks the ID, with the topic name as a second line of data. Its ID is
+// that of the newest stored event, for stores in this package, so that a
+// client reconnecting before the next event resumes from there.
+const HistoryExpiredEvent = "history-expired"
+
+// An EventStore keeps the history of broadcast events for replay to
+// reconnecting clients.
+type EventStore interface {
+	// Append stores an event. If the event has no ID, the store assigns
+	// one. It returns the event as stored.
+	Append(event Event) (Event, error)
+
+	// Since returns the stored events that followed the event with the
+	// given ID, oldest first. It returns ErrHistoryExpired if that event is
+	// not stored, because it aged out or never existed. The stores in this
+	// package seek by ID instead if the ID is not stored but sorts between
+	// the oldest and the newest stored IDs, as the IDs of events published
+	// meanwhile to another store do, see IDGenerator.
+	Since(id string) ([]Event, error)
+}
+
+// A deferredStore is an EventStore that can find the events following an
+// ID quickly and read them later. The manager finds them in step with
+// publishing and reads them outside of its locks.
+type deferredStore interface {
+	sinceLater(id string) (read func() ([]Event, error), err error)
+}
+
+// A headStore is an EventStore that tells the ID of its newest event, empty
+// if it has none.
+type headStore interface {
+	lastID() string
+}
+
+// MemoryStore is an EventStore keeping the most recent events in a ring
+// buffer. IDs it assigns are decimal sequence numbers.
+type MemoryStore struct {
+	mu     sync.Mutex
+	events []Event
+	next   uint64            // sequence number of the next event
+	index  map[string]uint64 // event ID to sequence number
+}
+
+// NewMemoryStore returns a MemoryStore holding up to capacity events.
+func NewMemoryStore(capacity int) *MemoryStore {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &MemoryStore{
+		events: make([]Event, capacity),
+		index:  make(map[string]uint64),
+	}
+}
+
+// Append implements EventStore.
+func (s *MemoryStore) Append(event Event) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.next
+	s.next++
+	if event.ID == "" && !event.ResetID {
+		event.ID = strconv.FormatUint(seq+1, 10)
+	}
+
+	slot := seq % uint64(len(s.events))
+	if seq >= uint64(len(s.events)) {
+		old := s.events[slot]
+		if n, ok := s.index[old.ID]; ok && n == seq-uint64(len(s.events)) {
+			delete(s.index, old.ID)
+		}
+	}
+
+	s.events[slot] = event
+	if event.ID != "" {
+		s.index[event.ID] = seq
+	}
+	return event, nil
+}
+
+// Since implements EventStore.
+func (s *MemoryStore) Since(id string) ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, ok := s.index[id]
+	from := seq + 1
+	if !ok {
+		if from, ok = s.seek(id); !ok {
+			return nil, ErrHistoryExpired
+		}
+	}
+
+	events := make([]Event, 0, s.next-from)
+	for n := from; n < s.next; n++ {
+		events = append(events, s.events[n%uint64(len(s.events))])
+	}
+	return events, nil
+}
+
+// seek returns the sequence number of the first stored event whose ID sorts
+// after id, as by idLess, if id sorts between the oldest and the newest
+// stored IDs. It must be called with s.mu locked.
+func (s *MemoryStore) seek(id string) (uint64, bool) {
+	var oldest uint64
+	if s.next > uint64(len(s.events)) {
+		oldest = s.next - uint64(len(s.events))
+	}
+	var after bool
+	for n := oldest; n < s.next; n++ {
+		stored := s.events[n%uint64(len(s.events))].ID
+		if stored == "" {
+			continue
+		}
+		if idLess(id, stored) {
+			return n, after
+		}
+		after = true
+	}
+	return 0, false
+}
+
+// lastID implements headStore.
+func (s *MemoryStore) lastID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next == 0 {
+		return ""
+	}
+	return s.events[(s.next-1)%uint64(len(s.events))].ID
+}
+
+// Len returns the number of stored events.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next < uint64(len(s.events)) {
+		return int(s.next)
+	}
+	return len(s.events)
+}
@@ -0,0 +1,44 @@
+package eventsource
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestStoreSeek resumes from IDs that are not stored: the stores seek to
+// the first ID after them, unless they fall outside the stored history.
+func TestStoreSeek(t *testing.T) {
+	fs, err := OpenFileStore(t.TempDir(), FileStoreOptions{SegmentSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	for _, store := range []EventStore{NewMemoryStore(10), fs} {
+		for _, id := range []string{"02", "04", "06", "08"} {
+			if _, err := store.Append(Event{ID: id, Data: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for id, want := range map[string]string{
+			"04": "06 08",
+			"03": "04 06 08",
+			"07": "08",
+			"01": "expired",
+			"09": "expired",
+		} {
+			events, err := store.Since(id)
+			got := "expired"
+			if err != ErrHistoryExpired {
+				var ids []string
+				for _, e := range events {
+					ids = append(ids, e.ID)
+				}
+				got = strings.Join(ids, " ")
+			}
+			if got != want {
+				t.Errorf("%T.Since(%s) = %s, want %s", store, id, got, want)
+			}
+		}
+	}
+}
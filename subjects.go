@@ -0,0 +1,93 @@
+package eventsource
+
+import "strings"
+
+// subjectNode is a node of the subscription trie. Each level matches one
+// token of a subject; wildcard tokens are stored as children named "*" and
+// "#".
+type subjectNode struct {
+	children    map[string]*subjectNode
+	subscribers map[*Encoder]struct{}
+}
+
+func newSubjectNode() *subjectNode {
+	return &subjectNode{
+		children:    make(map[string]*subjectNode),
+		subscribers: make(map[*Encoder]struct{}),
+	}
+}
+
+// splitSubject splits a subject or, if wildcards is set, a pattern into its
+// tokens. It reports false if a token is empty or misuses a wildcard. "#" is
+// only allowed as the last token.
+func splitSubject(s string, wildcards bool) ([]string, bool) {
+	tokens := strings.Split(s, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return nil, false
+		case token == "*" || token == "#":
+			if !wildcards || token == "#" && i != len(tokens)-1 {
+				return nil, false
+			}
+		case strings.ContainsAny(token, "*#"):
+			return nil, false
+		}
+	}
+	return tokens, true
+}
+
+// add subscribes encoder to the pattern made of tokens.
+func (n *subjectNode) add(tokens []string, encoder *Encoder) {
+	for _, token := range tokens {
+		child, ok := n.children[token]
+		if !ok {
+			child = newSubjectNode()
+			n.children[token] = child
+		}
+		n = child
+	}
+	n.subscribers[encoder] = struct{}{}
+}
+
+// remove unsubscribes encoder from the pattern made of tokens and prunes
+// the nodes left empty.
+func (n *subjectNode) remove(tokens []string, encoder *Encoder) {
+	if len(tokens) == 0 {
+		delete(n.subscribers, encoder)
+		return
+	}
+	child, ok := n.children[tokens[0]]
+	if !ok {
+		return
+	}
+	child.remove(tokens[1:], encoder)
+	if len(child.children) == 0 && len(child.subscribers) == 0 {
+		delete(n.children, tokens[0])
+	}
+}
+
+// match calls yield for the subscribers of every pattern matching the
+// subject made of tokens. Only the branches of the trie that can match are
+// visited, so the cost grows with the number of tokens, not of patterns. A
+// subscriber with several matching patterns is yielded once per pattern.
+func (n *subjectNode) match(tokens []string, yield func(*Encoder)) {
+	if len(tokens) == 0 {
+		for encoder := range n.subscribers {
+			yield(encoder)
+		}
+	} else {
+		if child, ok := n.children[tokens[0]]; ok {
+			child.match(tokens[1:], yield)
+		}
+		if child, ok := n.children["*"]; ok {
+			child.match(tokens[1:], yield)
+		}
+	}
+	// "#" ends a pattern and matches whatever tokens remain.
+	if child, ok := n.children["#"]; ok {
+		for encoder := range child.subscribers {
+			yield(encoder)
+		}
+	}
+}
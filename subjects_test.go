@@ -0,0 +1,104 @@
+package eventsource
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSplitSubject(t *testing.T) {
+	for _, tc := range []struct {
+		s         string
+		wildcards bool
+		ok        bool
+	}{
+		{"orders.eu.created", false, true},
+		{"orders.*.created", true, true},
+		{"orders.#", true, true},
+		{"#", true, true},
+		{"orders.*", false, false},
+		{"orders.#", false, false},
+		{"orders.#.created", true, false},
+		{"#.#", true, false},
+		{"orders..created", true, false},
+		{"orders.eu*", true, false},
+		{"", true, false},
+	} {
+		if _, ok := splitSubject(tc.s, tc.wildcards); ok != tc.ok {
+			t.Errorf("splitSubject(%q, %v) = %v, want %v", tc.s, tc.wildcards, ok, tc.ok)
+		}
+	}
+}
+
+func TestSubjectMatch(t *testing.T) {
+	root := newSubjectNode()
+	patterns := []string{"orders.eu.created", "orders.*.created", "orders.#", "#", "orders.*", "users.#"}
+	encoders := make(map[*Encoder]string)
+	for _, pattern := range patterns {
+		tokens, _ := splitSubject(pattern, true)
+		enc := NewEncoder(io.Discard)
+		encoders[enc] = pattern
+		root.add(tokens, enc)
+	}
+
+	for subject, want := range map[string]string{
+		"orders.eu.created": "# orders.# orders.*.created orders.eu.created",
+		"orders.us":         "# orders.# orders.*",
+		"orders":            "# orders.#",
+		"users.signup":      "# users.#",
+		"billing":           "#",
+	} {
+		tokens, _ := splitSubject(subject, false)
+		var got []string
+		root.match(tokens, func(enc *Encoder) {
+			got = append(got, encoders[enc])
+		})
+		sort.Strings(got)
+		if s := strings.Join(got, " "); s != want {
+			t.Errorf("%s matched %q, want %q", subject, s, want)
+		}
+	}
+}
+
+// BenchmarkPublishSubject publishes to a subject matching 10 of 100k
+// subscriptions, through the trie and through a BroadcastTo prefix filter
+// visiting every connection.
+func BenchmarkPublishSubject(b *testing.B) {
+	const subscriptions = 100000
+
+	cm := NewConnectionManager()
+	for i := 0; i < subscriptions; i++ {
+		enc := NewEncoder(io.Discard)
+		pattern := fmt.Sprintf("orders.r%d.created", i)
+		if i%10000 == 0 {
+			pattern = "orders.r0.#"
+		}
+		cm.Register(enc, &ConnectionInfo{Tags: map[string]string{"pattern": pattern}})
+		if err := cm.Subscribe(enc, pattern); err != nil {
+			b.Fatal(err)
+		}
+	}
+	event := Event{Type: "order", Data: []byte("{\"id\":42}")}
+
+	b.Run("Trie", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := cm.Publish("orders.r0.created", event); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("BroadcastTo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := cm.BroadcastTo(event, func(info *ConnectionInfo) bool {
+				return strings.HasPrefix(info.Tags["pattern"], "orders.r0.")
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}